@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gntry-io/auklet/pkg/auklet"
+	"github.com/spf13/viper"
+)
+
+// labelDefaults reads the default labels and the profiles from the config
+// file. Keys may omit the `auklet.` prefix, and may be nested, e.g.
+//
+//	defaults:
+//	  polling_interval: 30s
+//	profiles:
+//	  web:
+//	    metric:
+//	      cpu:
+//	        query: avg(cpu)
+func labelDefaults() (map[string]string, map[string]map[string]string) {
+	defaults := configLabels(viper.GetStringMap("defaults"))
+
+	profiles := make(map[string]map[string]string)
+	for name, v := range viper.GetStringMap("profiles") {
+		profiles[name] = configLabels(toStringMap(v))
+	}
+	return defaults, profiles
+}
+
+// notifyConfig reads the webhook notification settings from the config file,
+// using the same keys as the auklet.notify.* labels, e.g.
+//
+//	notify:
+//	  url: https://hooks.example.com/auklet
+//	  secret: s3cr3t
+//	  events: [scale]
+func notifyConfig() (auklet.Notify, error) {
+	labels := configLabels(map[string]interface{}{"notify": viper.GetStringMap("notify")})
+	return auklet.ParseNotify(labels, auklet.DefaultNotify())
+}
+
+// configLabels flattens a (nested) map from the config file into labels
+func configLabels(m map[string]interface{}) map[string]string {
+	flat := make(map[string]string)
+	flattenLabels(flat, "", m)
+
+	labels := make(map[string]string)
+	for k, v := range flat {
+		if !strings.HasPrefix(k, "auklet.") {
+			k = "auklet." + k
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+// flattenLabels adds all values in m to labels, joining the keys of nested
+// maps with dots. Lists are joined with commas.
+func flattenLabels(labels map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if nested := toStringMap(v); nested != nil {
+			flattenLabels(labels, prefix+k+".", nested)
+			continue
+		}
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, 0, len(list))
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			labels[prefix+k] = strings.Join(items, ",")
+			continue
+		}
+		labels[prefix+k] = fmt.Sprint(v)
+	}
+}
+
+// toStringMap returns v as map, or nil when v isn't a map
+func toStringMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		sm := make(map[string]interface{})
+		for k, v := range m {
+			sm[fmt.Sprint(k)] = v
+		}
+		return sm
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gntry-io/auklet/pkg/auklet"
+	"github.com/spf13/viper"
+)
+
+// readConfig loads the config file content into viper, the way the config
+// file is read by the daemon
+func readConfig(t *testing.T, format string, config string) {
+	t.Helper()
+	viper.Reset()
+	viper.SetConfigType(format)
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLabelDefaults(t *testing.T) {
+	defer viper.Reset()
+
+	for _, format := range []string{"yaml", "json"} {
+		config := `
+defaults:
+  polling_interval: 30s
+  auklet.down_graceperiod: 5m
+  Schedule:
+    Workday: "cron:0 8 * * 1-5;min=6;duration=10h"
+profiles:
+  Web:
+    scale_min: 2
+    scale_max: 10
+    metric:
+      CPU:
+        Query: avg(cpu)
+        up_threshold: 0.8
+`
+		if format == "json" {
+			config = `{
+  "defaults": {
+    "polling_interval": "30s",
+    "auklet.down_graceperiod": "5m",
+    "Schedule": {"Workday": "cron:0 8 * * 1-5;min=6;duration=10h"}
+  },
+  "profiles": {
+    "Web": {
+      "scale_min": 2,
+      "scale_max": 10,
+      "metric": {"CPU": {"Query": "avg(cpu)", "up_threshold": 0.8}}
+    }
+  }
+}`
+		}
+		readConfig(t, format, config)
+
+		defaults, profiles := labelDefaults()
+
+		// Nested keys are flattened, prefixed with auklet. once, and lowercased
+		expectedDefaults := map[string]string{
+			"auklet.polling_interval": "30s",
+			"auklet.down_graceperiod": "5m",
+			"auklet.schedule.workday": "cron:0 8 * * 1-5;min=6;duration=10h",
+		}
+		if !reflect.DeepEqual(defaults, expectedDefaults) {
+			t.Errorf("%s: expected defaults %v, got %v", format, expectedDefaults, defaults)
+		}
+		expectedProfiles := map[string]map[string]string{"web": {
+			"auklet.scale_min":               "2",
+			"auklet.scale_max":               "10",
+			"auklet.metric.cpu.query":        "avg(cpu)",
+			"auklet.metric.cpu.up_threshold": "0.8",
+		}}
+		if !reflect.DeepEqual(profiles, expectedProfiles) {
+			t.Errorf("%s: expected profiles %v, got %v", format, expectedProfiles, profiles)
+		}
+
+		// Services select the lowercased profile regardless of case
+		labels, err := auklet.MergeLabels(defaults, profiles, map[string]string{"auklet.profile": "Web"})
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+		} else if labels["auklet.metric.cpu.query"] != "avg(cpu)" || labels["auklet.polling_interval"] != "30s" {
+			t.Errorf("%s: expected the profile and defaults to be applied, got %v", format, labels)
+		}
+	}
+}
+
+func TestLabelDefaultsWithoutConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+
+	defaults, profiles := labelDefaults()
+	if len(defaults) != 0 || len(profiles) != 0 {
+		t.Errorf("expected no defaults or profiles, got %v and %v", defaults, profiles)
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	defer viper.Reset()
+	readConfig(t, "yaml", `
+notify:
+  url: https://hooks.example.com/auklet
+  events: [scale]
+  retries: 5
+  backoff: 2s
+`)
+
+	n, err := notifyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.URL != "https://hooks.example.com/auklet" || n.Retries != 5 || n.Backoff != 2*time.Second {
+		t.Errorf("expected the notification settings of the config file, got %+v", n)
+	}
+	// Lists are joined like the comma separated label
+	if !reflect.DeepEqual(n.Events, []string{auklet.NotifyEventScale}) {
+		t.Errorf("expected only scale events, got %v", n.Events)
+	}
+
+	readConfig(t, "yaml", "notify:\n  retries: many\n")
+	if _, err := notifyConfig(); err == nil {
+		t.Error("expected an error for invalid notification settings")
+	}
+}
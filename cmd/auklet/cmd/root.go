@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gntry-io/auklet/pkg/auklet"
 	"github.com/mitchellh/go-homedir"
@@ -26,9 +27,9 @@ var (
 
 			if viper.GetBool("no-color") {
 				logFormat = log.TextFormatter{
-					ForceColors: false,
-					DisableColors: true,
-					FullTimestamp: true,
+					ForceColors:     false,
+					DisableColors:   true,
+					FullTimestamp:   true,
 					TimestampFormat: "2006-01-02T15:04:05.999999999",
 				}
 			}
@@ -37,13 +38,25 @@ var (
 				log.SetFormatter(&log.JSONFormatter{})
 			}
 
-
 			auklet, err := auklet.New(viper.GetString("prometheus-url"), viper.GetInt("listen"))
 			if err != nil {
 				log.Error(err)
 				log.Error("Auklet aborted flight")
 				os.Exit(1)
 			}
+			auklet.DryRun = viper.GetBool("dry-run")
+			auklet.LeaderService = viper.GetString("leader-service")
+			auklet.LeaderIdentity = viper.GetString("leader-identity")
+			auklet.LeaseDuration = viper.GetDuration("lease-duration")
+			auklet.EventsRetryBudget = viper.GetDuration("events-retry-budget")
+			auklet.Defaults, auklet.Profiles = labelDefaults()
+			auklet.HistoryFile = viper.GetString("history-file")
+			auklet.APIToken = viper.GetString("api-token")
+			if auklet.Notify, err = notifyConfig(); err != nil {
+				log.Error(err)
+				log.Error("Auklet aborted flight")
+				os.Exit(1)
+			}
 
 			if err = auklet.Fly(); err != nil {
 				log.Error(err)
@@ -54,18 +67,29 @@ var (
 	}
 
 	logFormat = log.TextFormatter{
-		ForceColors: true,
-		DisableColors: false,
-		FullTimestamp: true,
+		ForceColors:     true,
+		DisableColors:   false,
+		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02T15:04:05.999999999",
 	}
 
 	cfgFile  string
 	promURL  string
 	debug    bool
-	json	 bool
+	json     bool
 	nocolor  bool
 	httpPort int
+	dryRun   bool
+
+	leaderService  string
+	leaderIdentity string
+	leaseDuration  time.Duration
+
+	eventsRetryBudget time.Duration
+
+	historyFile string
+
+	apiToken string
 )
 
 func init() {
@@ -82,12 +106,26 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&json, "json", "j", false, "Log output in JSON format")
 	RootCmd.PersistentFlags().StringVarP(&promURL, "prometheus-url", "p", "", "Prometheus API URL")
 	RootCmd.PersistentFlags().IntVarP(&httpPort, "listen", "l", 8080, "Port of HTTP listener")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "decide on scaling, but never update services")
+	RootCmd.PersistentFlags().StringVar(&leaderService, "leader-service", "", "name of Auklet's own service; enables leader election")
+	RootCmd.PersistentFlags().StringVar(&leaderIdentity, "leader-identity", hostname(), "identity of this instance in leader election")
+	RootCmd.PersistentFlags().DurationVar(&leaseDuration, "lease-duration", auklet.DefaultLeaseDuration, "duration of the leader lease")
+	RootCmd.PersistentFlags().DurationVar(&eventsRetryBudget, "events-retry-budget", auklet.DefaultEventsRetryBudget, "how long to keep reconnecting to the Docker event stream before giving up")
+	RootCmd.PersistentFlags().StringVar(&historyFile, "history-file", "", "append every scaling decision as JSON line to this file")
+	RootCmd.PersistentFlags().StringVar(&apiToken, "api-token", "", "bearer token required to pause, resume and override services through the API")
 	_ = RootCmd.MarkFlagRequired("prometheus-url")
 	_ = viper.BindPFlag("debug", RootCmd.PersistentFlags().Lookup("debug"))
 	_ = viper.BindPFlag("prometheus-url", RootCmd.PersistentFlags().Lookup("prometheus-url"))
 	_ = viper.BindPFlag("json", RootCmd.PersistentFlags().Lookup("json"))
 	_ = viper.BindPFlag("no-color", RootCmd.PersistentFlags().Lookup("no-color"))
 	_ = viper.BindPFlag("listen", RootCmd.PersistentFlags().Lookup("listen"))
+	_ = viper.BindPFlag("dry-run", RootCmd.PersistentFlags().Lookup("dry-run"))
+	_ = viper.BindPFlag("leader-service", RootCmd.PersistentFlags().Lookup("leader-service"))
+	_ = viper.BindPFlag("leader-identity", RootCmd.PersistentFlags().Lookup("leader-identity"))
+	_ = viper.BindPFlag("lease-duration", RootCmd.PersistentFlags().Lookup("lease-duration"))
+	_ = viper.BindPFlag("events-retry-budget", RootCmd.PersistentFlags().Lookup("events-retry-budget"))
+	_ = viper.BindPFlag("history-file", RootCmd.PersistentFlags().Lookup("history-file"))
+	_ = viper.BindPFlag("api-token", RootCmd.PersistentFlags().Lookup("api-token"))
 }
 
 func initConfig() {
@@ -119,6 +157,15 @@ func initConfig() {
 	}
 }
 
+// hostname returns the hostname, which in a Swarm task is the container ID
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return h
+}
+
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
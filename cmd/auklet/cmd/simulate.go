@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	enc "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gntry-io/auklet/pkg/auklet"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	labelFile   string
+	labelFlags  []string
+	seriesFile  string
+	simReplicas int
+	simPlot     bool
+	simJSON     bool
+
+	// Definition of the simulate subcommand
+	simulateCmd = &cobra.Command{
+		Use:   "simulate",
+		Short: "Replay a metric series against a service configuration",
+		Long: `Replay a metric series against the auklet labels of a service, and show
+how the service would have been scaled. The labels are read from a file
+(key=value lines, a JSON object or the output of 'docker service inspect')
+and/or given with --label. The series is read from a CSV file (time,value or
+a header with one column per metric), a JSON array of {"time","value"} or
+{"time","values"} objects, or the JSON result of a Prometheus range query.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if !debug {
+				// Only show the simulation, not every scale action
+				log.SetLevel(log.WarnLevel)
+			}
+
+			if err := runSimulate(os.Stdout); err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	simulateCmd.Flags().StringVarP(&labelFile, "labels", "f", "", "file containing the service labels")
+	simulateCmd.Flags().StringArrayVar(&labelFlags, "label", nil, "service label (key=value); overrides labels from the file")
+	simulateCmd.Flags().StringVarP(&seriesFile, "series", "s", "", "file containing the metric series")
+	simulateCmd.Flags().IntVarP(&simReplicas, "replicas", "r", -1, "initial number of replicas (default scale_min)")
+	simulateCmd.Flags().BoolVar(&simPlot, "plot", false, "plot the number of replicas over time")
+	simulateCmd.Flags().BoolVar(&simJSON, "output-json", false, "print the simulation steps as JSON")
+	_ = simulateCmd.MarkFlagRequired("series")
+	RootCmd.AddCommand(simulateCmd)
+}
+
+// runSimulate reads the labels and series, runs the simulation and writes the
+// result to w
+func runSimulate(w io.Writer) error {
+	labels, err := readLabels(labelFile, labelFlags)
+	if err != nil {
+		return err
+	}
+	defaults, profiles := labelDefaults()
+	labels, err = auklet.MergeLabels(defaults, profiles, labels)
+	if err != nil {
+		return err
+	}
+
+	series, err := readSeries(seriesFile)
+	if err != nil {
+		return err
+	}
+
+	steps, err := auklet.Simulate(labels, simReplicas, series)
+	if err != nil {
+		return err
+	}
+
+	if simJSON {
+		e := enc.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(steps)
+	}
+
+	printSteps(w, steps)
+	if simPlot {
+		fmt.Fprintln(w)
+		plotReplicas(w, steps)
+	}
+	return nil
+}
+
+// readLabels reads the labels from file (if set), and applies the labels given
+// as key=value pairs on top of them
+func readLabels(file string, pairs []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read labels: %v", err)
+		}
+		labels, err = parseLabels(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse labels from %s: %v", file, err)
+		}
+	}
+
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label %q: must be key=value", p)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	if len(labels) == 0 {
+		return nil, errors.New("no labels given; use --labels and/or --label")
+	}
+	return labels, nil
+}
+
+// parseLabels parses labels from a JSON object, the output of `docker service
+// inspect` or key=value lines
+func parseLabels(data []byte) (map[string]string, error) {
+	data = bytes.TrimSpace(data)
+	labels := make(map[string]string)
+
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		var services []swarm.Service
+		if err := enc.Unmarshal(data, &services); err != nil {
+			return nil, err
+		}
+		if len(services) != 1 {
+			return nil, fmt.Errorf("expected 1 service, found %d", len(services))
+		}
+		for k, v := range services[0].Spec.Labels {
+			labels[k] = v
+		}
+
+	case bytes.HasPrefix(data, []byte("{")):
+		if err := enc.Unmarshal(data, &labels); err != nil {
+			return nil, err
+		}
+
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid line %q: must be key=value", line)
+			}
+			labels[kv[0]] = kv[1]
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return labels, nil
+}
+
+// readSeries reads the metric series from a CSV or JSON file
+func readSeries(file string) (map[string][]auklet.Sample, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read series: %v", err)
+	}
+
+	series, err := parseSeries(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse series from %s: %v", file, err)
+	}
+	return series, nil
+}
+
+// parseSeries parses a JSON or CSV series
+func parseSeries(data []byte) (map[string][]auklet.Sample, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) || bytes.HasPrefix(data, []byte("{")) {
+		return parseJSONSeries(data)
+	}
+	return parseCSVSeries(data)
+}
+
+// parseCSVSeries parses a CSV series. The first column holds the time, the
+// other columns the values. When the first row is a header the columns are
+// named after the metrics, otherwise a single value column is expected.
+func parseCSVSeries(data []byte) (map[string][]auklet.Sample, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no samples")
+	}
+
+	names := []string{auklet.DefaultMetricName}
+	if _, err := parseTime(records[0][0]); err != nil {
+		names = records[0][1:]
+		records = records[1:]
+	}
+
+	series := make(map[string][]auklet.Sample)
+	for i, rec := range records {
+		if len(rec) != len(names)+1 {
+			return nil, fmt.Errorf("line %d: expected %d columns", i+1, len(names)+1)
+		}
+		t, err := parseTime(rec[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		for j, name := range names {
+			v, err := strconv.ParseFloat(strings.TrimSpace(rec[j+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value: %v", i+1, err)
+			}
+			series[name] = append(series[name], auklet.Sample{Time: t, Value: v})
+		}
+	}
+	return series, nil
+}
+
+// jsonSample is a sample in a JSON series
+type jsonSample struct {
+	Time   interface{}        `json:"time"`
+	Value  *float64           `json:"value"`
+	Values map[string]float64 `json:"values"`
+}
+
+// rangeQueryResponse is the response of the Prometheus range query API
+type rangeQueryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+}
+
+// parseJSONSeries parses a JSON array of samples, or the response of a
+// Prometheus range query that returned a single series
+func parseJSONSeries(data []byte) (map[string][]auklet.Sample, error) {
+	series := make(map[string][]auklet.Sample)
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		var resp rangeQueryResponse
+		if err := enc.Unmarshal(data, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Status != "success" || resp.Data.ResultType != "matrix" {
+			return nil, errors.New("not a successful Prometheus range query result")
+		}
+		switch n := len(resp.Data.Result); {
+		case n == 0:
+			return nil, errors.New("the range query returned no series")
+		case n > 1:
+			// Auklet aggregates the values of an instant query, but a range
+			// query can't be replayed the same way
+			return nil, fmt.Errorf("the range query returned %d series (%s, ...), but a single series is "+
+				"needed; aggregate the query, e.g. with sum(), or export the series as CSV with a column per metric",
+				n, resp.Data.Result[0].Metric)
+		}
+		for _, p := range resp.Data.Result[0].Values {
+			series[auklet.DefaultMetricName] = append(series[auklet.DefaultMetricName], auklet.Sample{
+				Time:  p.Timestamp.Time(),
+				Value: float64(p.Value),
+			})
+		}
+		return series, nil
+	}
+
+	var samples []jsonSample
+	if err := enc.Unmarshal(data, &samples); err != nil {
+		return nil, err
+	}
+	for i, s := range samples {
+		t, err := parseTime(fmt.Sprint(s.Time))
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %v", i+1, err)
+		}
+		if s.Value != nil {
+			series[auklet.DefaultMetricName] = append(series[auklet.DefaultMetricName], auklet.Sample{Time: t, Value: *s.Value})
+		}
+		for name, v := range s.Values {
+			series[name] = append(series[name], auklet.Sample{Time: t, Value: v})
+		}
+	}
+	return series, nil
+}
+
+// parseTime parses an RFC 3339 time or a Unix timestamp in seconds
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Unix(0, int64(f*float64(time.Second))).UTC(), nil
+}
+
+// printSteps writes a table with the replicas at every step, and the scale
+// decision that was made
+func printSteps(w io.Writer, steps []auklet.SimulationStep) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tVALUES\tSTATE\tREPLICAS\tDECISION")
+	for _, s := range steps {
+		names := make([]string, 0, len(s.Values))
+		for name := range s.Values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("%s=%g", name, s.Values[name]))
+		}
+
+		decision := ""
+		if d := s.Decision; d != nil {
+			decision = fmt.Sprintf("scale %d -> %d", d.FromReplicas, d.ToReplicas)
+			if d.Driver != "" {
+				decision += fmt.Sprintf(" (%s)", d.Driver)
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", s.Time.Format(time.RFC3339), strings.Join(values, " "), s.State, s.Replicas, decision)
+	}
+	_ = tw.Flush()
+}
+
+// plotWidth is the maximum number of columns of the replica plot
+const plotWidth = 72
+
+// plotReplicas writes an ASCII plot of the number of replicas over time
+func plotReplicas(w io.Writer, steps []auklet.SimulationStep) {
+	if len(steps) == 0 {
+		return
+	}
+
+	// Every column shows the maximum number of replicas of its steps
+	perColumn := (len(steps) + plotWidth - 1) / plotWidth
+	var columns []int
+	min, max := steps[0].Replicas, steps[0].Replicas
+	for i := 0; i < len(steps); i += perColumn {
+		c := steps[i].Replicas
+		for _, s := range steps[i:minInt(i+perColumn, len(steps))] {
+			if s.Replicas > c {
+				c = s.Replicas
+			}
+		}
+		columns = append(columns, c)
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+	}
+
+	for r := max; r >= min; r-- {
+		var line strings.Builder
+		for _, c := range columns {
+			switch {
+			case c == r:
+				line.WriteByte('*')
+			case c > r:
+				line.WriteByte('|')
+			default:
+				line.WriteByte(' ')
+			}
+		}
+		fmt.Fprintf(w, "%4d |%s\n", r, strings.TrimRight(line.String(), " "))
+	}
+	fmt.Fprintf(w, "     +%s\n", strings.Repeat("-", len(columns)))
+	fmt.Fprintf(w, "      %s - %s\n", steps[0].Time.Format(time.RFC3339), steps[len(steps)-1].Time.Format(time.RFC3339))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
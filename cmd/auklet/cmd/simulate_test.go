@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gntry-io/auklet/pkg/auklet"
+)
+
+// t0 is the time of the first sample in the test series
+var t0 = time.Date(2018, 12, 3, 12, 0, 0, 0, time.UTC)
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected time.Time
+	}{
+		{"2018-12-03T12:00:00Z", t0},
+		{" 2018-12-03T13:00:00+01:00 ", t0},
+		{"1543838400", t0},
+		{"1543838400.5", t0.Add(500 * time.Millisecond)},
+	} {
+		got, err := parseTime(tc.s)
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+			continue
+		}
+		if !got.Equal(tc.expected) {
+			t.Errorf("%q: expected %s, got %s", tc.s, tc.expected, got)
+		}
+	}
+
+	if _, err := parseTime("yesterday"); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestParseSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected map[string][]auklet.Sample
+	}{
+		{
+			name: "CSV without header",
+			data: "2018-12-03T12:00:00Z,1\n1543838430, 2.5\n",
+			expected: map[string][]auklet.Sample{auklet.DefaultMetricName: {
+				{Time: t0, Value: 1},
+				{Time: t0.Add(30 * time.Second), Value: 2.5},
+			}},
+		},
+		{
+			name: "CSV with header",
+			data: "time,cpu,queue\n1543838400,50,3\n1543838430,60,4\n",
+			expected: map[string][]auklet.Sample{
+				"cpu":   {{Time: t0, Value: 50}, {Time: t0.Add(30 * time.Second), Value: 60}},
+				"queue": {{Time: t0, Value: 3}, {Time: t0.Add(30 * time.Second), Value: 4}},
+			},
+		},
+		{
+			name: "JSON values",
+			data: `[{"time": "2018-12-03T12:00:00Z", "value": 1}, {"time": 1543838430, "value": 2}]`,
+			expected: map[string][]auklet.Sample{auklet.DefaultMetricName: {
+				{Time: t0, Value: 1},
+				{Time: t0.Add(30 * time.Second), Value: 2},
+			}},
+		},
+		{
+			name: "JSON values per metric",
+			data: `[{"time": 1543838400, "values": {"cpu": 50, "queue": 3}}, {"time": 1543838430, "values": {"cpu": 60}}]`,
+			expected: map[string][]auklet.Sample{
+				"cpu":   {{Time: t0, Value: 50}, {Time: t0.Add(30 * time.Second), Value: 60}},
+				"queue": {{Time: t0, Value: 3}},
+			},
+		},
+		{
+			name: "Prometheus range query",
+			data: `{"status": "success", "data": {"resultType": "matrix", "result": [
+				{"metric": {"service": "web"}, "values": [[1543838400, "1"], [1543838430.5, "2.5"]]}
+			]}}`,
+			expected: map[string][]auklet.Sample{auklet.DefaultMetricName: {
+				{Time: t0, Value: 1},
+				{Time: t0.Add(30500 * time.Millisecond), Value: 2.5},
+			}},
+		},
+	} {
+		series, err := parseSeries([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(series) != len(tc.expected) {
+			t.Errorf("%s: expected %d series, got %d", tc.name, len(tc.expected), len(series))
+			continue
+		}
+		for name, expected := range tc.expected {
+			samples := series[name]
+			if len(samples) != len(expected) {
+				t.Errorf("%s: expected %d samples of %s, got %d", tc.name, len(expected), name, len(samples))
+				continue
+			}
+			for i := range expected {
+				if !samples[i].Time.Equal(expected[i].Time) || samples[i].Value != expected[i].Value {
+					t.Errorf("%s: expected sample %d of %s to be %v, got %v", tc.name, i, name, expected[i], samples[i])
+				}
+			}
+		}
+	}
+}
+
+func TestParseSeriesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"CSV without samples", "", "no samples"},
+		{"CSV invalid time", "time,cpu\nnoon,1\n", `line 1: invalid time "noon"`},
+		{"CSV invalid value", "1543838400,high\n", "line 1: invalid value"},
+		{"CSV missing column", "time,cpu,queue\n1543838400,1\n", "wrong number of fields"},
+		{"JSON invalid time", `[{"time": "noon", "value": 1}]`, `sample 1: invalid time "noon"`},
+		{"failed range query", `{"status": "error"}`, "not a successful Prometheus range query result"},
+		{"instant query", `{"status": "success", "data": {"resultType": "vector", "result": []}}`, "not a successful Prometheus range query result"},
+		{"range query without series", `{"status": "success", "data": {"resultType": "matrix", "result": []}}`, "the range query returned no series"},
+		{
+			"range query with multiple series",
+			`{"status": "success", "data": {"resultType": "matrix", "result": [
+				{"metric": {"instance": "a"}, "values": [[1543838400, "1"]]},
+				{"metric": {"instance": "b"}, "values": [[1543838400, "2"]]}
+			]}}`,
+			`the range query returned 2 series ({instance="a"}, ...), but a single series is needed; aggregate the query`,
+		},
+	} {
+		_, err := parseSeries([]byte(tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	expected := map[string]string{"auklet.autoscale": "true", "auklet.scale_max": "10"}
+
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"key=value lines", "# web\nauklet.autoscale=true\n\nauklet.scale_max=10\n"},
+		{"JSON object", `{"auklet.autoscale": "true", "auklet.scale_max": "10"}`},
+		{"docker service inspect", `[{"Spec": {"Labels": {"auklet.autoscale": "true", "auklet.scale_max": "10"}}}]`},
+	} {
+		labels, err := parseLabels([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(labels, expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, expected, labels)
+		}
+	}
+
+	if _, err := parseLabels([]byte("auklet.autoscale")); err == nil {
+		t.Error("expected an error for a line without value")
+	}
+	if _, err := parseLabels([]byte("[]")); err == nil {
+		t.Error("expected an error without a service")
+	}
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gntry-io/auklet/pkg/auklet"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	validateLive bool
+
+	// Definition of the validate subcommand
+	validateCmd = &cobra.Command{
+		Use:   "validate [compose file...]",
+		Short: "Validate the auklet labels of services",
+		Long: `Strictly validate the auklet labels of all services with auklet.autoscale
+set, read from the deploy labels of compose/stack files and/or from the live
+services in the Swarm (--live). Exits with a non-zero status when any of the
+services has an invalid configuration.
+
+Queries are not parsed as PromQL; they are only checked for balanced brackets
+and closed strings after rendering their templates.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 && !validateLive {
+				log.Error("Specify one or more compose files and/or --live")
+				os.Exit(1)
+			}
+
+			valid, err := runValidate(os.Stdout, args, validateLive)
+			if err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+			if !valid {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	validateCmd.Flags().BoolVar(&validateLive, "live", false, "validate the services in the Swarm")
+	RootCmd.AddCommand(validateCmd)
+}
+
+// serviceLabels are the labels of a single service to validate
+type serviceLabels struct {
+	Name   string
+	Labels map[string]string
+}
+
+// runValidate validates the services from the compose files and/or Swarm,
+// writes a report to w and returns whether all services are valid
+func runValidate(w io.Writer, files []string, live bool) (bool, error) {
+	var services []serviceLabels
+	for _, file := range files {
+		s, err := readComposeFile(file)
+		if err != nil {
+			return false, err
+		}
+		services = append(services, s...)
+	}
+
+	if live {
+		s, err := readLiveServices()
+		if err != nil {
+			return false, err
+		}
+		services = append(services, s...)
+	}
+
+	defaults, profiles := labelDefaults()
+	valid := true
+	validated := 0
+	for _, s := range services {
+		if v, isSet := s.Labels["auklet.autoscale"]; !isSet {
+			continue
+		} else if e, err := strconv.ParseBool(v); err == nil && !e {
+			continue
+		}
+
+		validated++
+		var errs []error
+		if labels, err := auklet.MergeLabels(defaults, profiles, s.Labels); err != nil {
+			errs = append(errs, err)
+		} else {
+			errs = auklet.ValidateLabels(labels)
+		}
+		if len(errs) == 0 {
+			fmt.Fprintf(w, "%s: OK\n", s.Name)
+			continue
+		}
+
+		valid = false
+		fmt.Fprintf(w, "%s: %d problem(s)\n", s.Name, len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(w, "  - %v\n", err)
+		}
+	}
+
+	if validated == 0 {
+		fmt.Fprintln(w, "No services with auklet.autoscale found")
+	} else {
+		fmt.Fprintln(w, "Note: queries are only checked for balanced brackets and closed strings, not parsed as PromQL")
+	}
+	return valid, nil
+}
+
+// composeFile is the part of a compose/stack file that holds the labels
+type composeFile struct {
+	Services map[string]struct {
+		Deploy struct {
+			Labels interface{} `yaml:"labels"`
+		} `yaml:"deploy"`
+	} `yaml:"services"`
+}
+
+// readComposeFile reads the deploy labels of all services in a compose/stack
+// file. Labels can be given as a map or as a list of key=value strings.
+func readComposeFile(file string) ([]serviceLabels, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read compose file: %v", err)
+	}
+
+	var compose composeFile
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, fmt.Errorf("could not parse compose file %s: %v", file, err)
+	}
+
+	var services []serviceLabels
+	for name, s := range compose.Services {
+		labels := make(map[string]string)
+		switch l := s.Deploy.Labels.(type) {
+		case nil:
+		case map[interface{}]interface{}:
+			for k, v := range l {
+				labels[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		case []interface{}:
+			for _, item := range l {
+				kv := strings.SplitN(fmt.Sprint(item), "=", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "")
+				}
+				labels[kv[0]] = kv[1]
+			}
+		default:
+			return nil, fmt.Errorf("invalid deploy labels of service %s in %s", name, file)
+		}
+		services = append(services, serviceLabels{Name: name, Labels: labels})
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// readLiveServices reads the labels of all services in the Swarm
+func readLiveServices() ([]serviceLabels, error) {
+	dockerClient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating Docker client: %v", err)
+	}
+	defer dockerClient.Close()
+
+	list, err := dockerClient.ServiceList(context.Background(), types.ServiceListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch services from Docker Swarm: %v", err)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no services found on Docker Swarm")
+	}
+
+	var services []serviceLabels
+	for _, s := range list {
+		services = append(services, serviceLabels{Name: s.Spec.Name, Labels: s.Spec.Labels})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
@@ -0,0 +1,60 @@
+package auklet
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Labels Auklet writes on a service whenever it scales it, so that
+// `docker service inspect` shows why the service was changed
+const (
+	LastScaledAtLabel    = "auklet.last_scaled_at"
+	LastScaleReasonLabel = "auklet.last_scale_reason"
+	LastMetricValueLabel = "auklet.last_metric_value"
+)
+
+// annotationLabels are the labels written by Auklet itself; they don't
+// configure autoscaling, so changing them doesn't reconfigure the service
+var annotationLabels = map[string]bool{
+	LastScaledAtLabel:    true,
+	LastScaleReasonLabel: true,
+	LastMetricValueLabel: true,
+}
+
+// annotations returns the labels describing the decision to scale the service
+// to the given number of replicas
+func (s *Service) annotations(replicas int) map[string]string {
+	direction := "down"
+	if replicas > s.CurrentReplicas {
+		direction = "up"
+	}
+	reason := fmt.Sprintf("scale %s from %d to %d", direction, s.CurrentReplicas, replicas)
+
+	labels := map[string]string{
+		LastScaledAtLabel: s.auklet.Clock.Now().UTC().Format(time.RFC3339),
+	}
+	if m := s.metric(s.Driver); m != nil {
+		switch {
+		case s.Mode == ModeTarget:
+			reason += fmt.Sprintf(": metric %s is %g (target_value %g)", m.Name, m.Value, m.TargetValue)
+		case direction == "up":
+			reason += fmt.Sprintf(": metric %s is %g (up_threshold %g)", m.Name, m.Value, m.UpThreshold)
+		default:
+			reason += fmt.Sprintf(": metric %s is %g (down_threshold %g)", m.Name, m.Value, m.DownThreshold)
+		}
+		labels[LastMetricValueLabel] = strconv.FormatFloat(m.Value, 'g', -1, 64)
+	}
+	labels[LastScaleReasonLabel] = reason
+	return labels
+}
+
+// metric returns the metric of the service with the given name, or nil
+func (s *Service) metric(name string) *Metric {
+	for _, m := range s.Metrics {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
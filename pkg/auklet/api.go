@@ -0,0 +1,338 @@
+package auklet
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ServiceStatus is the representation of a monitored service, its parsed
+// configuration and current state as returned by the API.
+type ServiceStatus struct {
+	ServiceID       string           `json:"service_id"`
+	ServiceName     string           `json:"service_name"`
+	State           string           `json:"state"`
+	ConfigValid     bool             `json:"config_valid"`
+	ConfigError     string           `json:"config_error,omitempty"`
+	Mode            string           `json:"mode"`
+	PollInterval    string           `json:"polling_interval"`
+	LastPoll        *time.Time       `json:"last_poll,omitempty"`
+	CurrentReplicas int              `json:"current_replicas"`
+	MinReplicas     int              `json:"min_replicas"`
+	MaxReplicas     int              `json:"max_replicas"`
+	BaseMinReplicas int              `json:"base_min_replicas"`
+	BaseMaxReplicas int              `json:"base_max_replicas"`
+	UpStep          int              `json:"up_step"`
+	DownStep        int              `json:"down_step"`
+	TargetTolerance float64          `json:"target_tolerance,omitempty"`
+	Metrics         []Metric         `json:"metrics"`
+	Driver          string           `json:"driver,omitempty"`
+	UpGracePeriod   string           `json:"up_graceperiod"`
+	DownGracePeriod string           `json:"down_graceperiod"`
+	GraceTimer      *time.Time       `json:"grace_timer,omitempty"`
+	GraceElapsed    string           `json:"grace_elapsed,omitempty"`
+	UpCooldown      string           `json:"up_cooldown"`
+	DownCooldown    string           `json:"down_cooldown"`
+	CooldownScope   string           `json:"cooldown_scope"`
+	CooldownUntil   *time.Time       `json:"cooldown_until,omitempty"`
+	OnError         string           `json:"on_error"`
+	OnErrorAfter    int              `json:"on_error_after"`
+	Failures        int              `json:"failures"`
+	Schedules       []ScheduleStatus `json:"schedules,omitempty"`
+	ActiveSchedules []string         `json:"active_schedules,omitempty"`
+	DryRun          bool             `json:"dry_run"`
+	Paused          bool             `json:"paused"`
+	PinnedReplicas  *int             `json:"pinned_replicas,omitempty"`
+	PinnedUntil     *time.Time       `json:"pinned_until,omitempty"`
+}
+
+// overrideRequest is the request body of the override endpoint
+type overrideRequest struct {
+	Replicas *int   `json:"replicas"`
+	TTL      string `json:"ttl"`
+}
+
+// ScheduleStatus is the representation of a service schedule as returned by
+// the API.
+type ScheduleStatus struct {
+	Name        string `json:"name"`
+	Cron        string `json:"cron"`
+	MinReplicas *int   `json:"min_replicas,omitempty"`
+	MaxReplicas *int   `json:"max_replicas,omitempty"`
+	Duration    string `json:"duration"`
+	Timezone    string `json:"timezone"`
+}
+
+// registerAPIHandlers registers all API endpoints on the given router
+func (a *Auklet) registerAPIHandlers(router *mux.Router) {
+	router.HandleFunc("/services", a.handleListServices).Methods(http.MethodGet)
+	router.HandleFunc("/services/{id}", a.handleGetService).Methods(http.MethodGet)
+	router.HandleFunc("/services/{id}/history", a.handleServiceHistory).Methods(http.MethodGet)
+	router.HandleFunc("/services/{id}/pause", a.requireToken(a.handlePauseService)).Methods(http.MethodPost)
+	router.HandleFunc("/services/{id}/resume", a.requireToken(a.handleResumeService)).Methods(http.MethodPost)
+	router.HandleFunc("/services/{id}/override", a.requireToken(a.handleOverrideService)).Methods(http.MethodPost)
+	router.HandleFunc("/services/{id}/override", a.requireToken(a.handleDeleteOverride)).Methods(http.MethodDelete)
+}
+
+// requireToken rejects requests that don't carry the API token as bearer
+// token, when one is configured
+func (a *Auklet) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + a.APIToken)
+		if a.APIToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleListServices returns the status of all monitored services
+func (a *Auklet) handleListServices(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	services := make([]*Service, 0, len(a.services))
+	for _, svc := range a.services {
+		services = append(services, svc)
+	}
+	a.Unlock()
+
+	statuses := make([]ServiceStatus, 0, len(services))
+	for _, svc := range services {
+		statuses = append(statuses, a.serviceStatus(svc))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ServiceName < statuses[j].ServiceName })
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleGetService returns the status of a single monitored service
+func (a *Auklet) handleGetService(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.serviceStatus(svc))
+}
+
+// handleServiceHistory returns the decision history of a single monitored
+// service, oldest decision first
+func (a *Auklet) handleServiceHistory(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+	writeJSON(w, http.StatusOK, svc.history())
+}
+
+// handlePauseService pauses autoscaling of a service
+func (a *Auklet) handlePauseService(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+	a.pauseService(svc.ServiceID)
+	writeJSON(w, http.StatusOK, a.serviceStatus(svc))
+}
+
+// handleResumeService resumes autoscaling of a service, removing both the
+// pause and the replica override
+func (a *Auklet) handleResumeService(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+	a.resumeService(svc.ServiceID)
+	writeJSON(w, http.StatusOK, a.serviceStatus(svc))
+}
+
+// handleOverrideService pins a service to a fixed number of replicas for a
+// limited time
+func (a *Auklet) handleOverrideService(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+
+	var req overrideRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	// A pin of a service with an invalid configuration would never be applied,
+	// as the service isn't polled
+	status := svc.status()
+	if !status.ConfigValid {
+		writeError(w, http.StatusConflict, "autoscaling configuration of the service is invalid")
+		return
+	}
+
+	if req.Replicas == nil {
+		writeError(w, http.StatusBadRequest, "replicas must be set")
+		return
+	}
+	if *req.Replicas < status.BaseMinReplicas || *req.Replicas > status.BaseMaxReplicas {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("replicas must be between scale_min (%d) and scale_max (%d)",
+			status.BaseMinReplicas, status.BaseMaxReplicas))
+		return
+	}
+	if req.TTL == "" {
+		writeError(w, http.StatusBadRequest, "ttl must be set")
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid ttl: "+err.Error())
+		return
+	}
+	if ttl <= 0 {
+		writeError(w, http.StatusBadRequest, "ttl must be positive")
+		return
+	}
+
+	a.pinService(svc.ServiceID, *req.Replicas, ttl)
+	writeJSON(w, http.StatusOK, a.serviceStatus(svc))
+}
+
+// handleDeleteOverride removes the replica override of a service
+func (a *Auklet) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	svc := a.lookupService(mux.Vars(r)["id"])
+	if svc == nil {
+		writeError(w, http.StatusNotFound, "service not monitored")
+		return
+	}
+	a.unpinService(svc.ServiceID)
+	writeJSON(w, http.StatusOK, a.serviceStatus(svc))
+}
+
+// serviceStatus returns the status of the service including its manual
+// overrides
+func (a *Auklet) serviceStatus(svc *Service) ServiceStatus {
+	status := svc.status()
+
+	control := a.getControl(svc.ServiceID)
+	status.Paused = control.Paused
+	if control.Pinned {
+		replicas, until := control.Replicas, control.Until
+		status.PinnedReplicas = &replicas
+		status.PinnedUntil = &until
+	}
+	return status
+}
+
+// lookupService finds a monitored service by its ID or name
+func (a *Auklet) lookupService(id string) *Service {
+	a.Lock()
+	defer a.Unlock()
+
+	if svc, found := a.services[id]; found {
+		return svc
+	}
+	for _, svc := range a.services {
+		if svc.ServiceName == id {
+			return svc
+		}
+	}
+	return nil
+}
+
+// status takes a consistent snapshot of the service
+func (s *Service) status() ServiceStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	status := ServiceStatus{
+		ServiceID:       s.ServiceID,
+		ServiceName:     s.ServiceName,
+		State:           s.state.String(),
+		ConfigValid:     s.ConfigError == "",
+		ConfigError:     s.ConfigError,
+		Mode:            s.Mode,
+		PollInterval:    s.PollInterval.String(),
+		CurrentReplicas: s.CurrentReplicas,
+		MinReplicas:     s.MinReplicas,
+		MaxReplicas:     s.MaxReplicas,
+		BaseMinReplicas: s.BaseMinReplicas,
+		BaseMaxReplicas: s.BaseMaxReplicas,
+		UpStep:          s.UpStep,
+		DownStep:        s.DownStep,
+		TargetTolerance: s.TargetTolerance,
+		Driver:          s.Driver,
+		UpGracePeriod:   s.UpGracePeriod.String(),
+		DownGracePeriod: s.DownGracePeriod.String(),
+		UpCooldown:      s.UpCooldown.String(),
+		DownCooldown:    s.DownCooldown.String(),
+		CooldownScope:   s.CooldownScope,
+		OnError:         s.OnError,
+		OnErrorAfter:    s.OnErrorAfter,
+		Failures:        s.Failures,
+		ActiveSchedules: s.ActiveSchedules,
+		DryRun:          s.DryRun || s.auklet.DryRun,
+	}
+
+	if !s.LastPoll.IsZero() {
+		t := s.LastPoll
+		status.LastPoll = &t
+	}
+
+	if !s.GraceTimer.IsZero() {
+		t := s.GraceTimer
+		status.GraceTimer = &t
+		status.GraceElapsed = s.auklet.Clock.Now().Sub(t).String()
+	}
+
+	if !s.CooldownUntil.IsZero() {
+		t := s.CooldownUntil
+		status.CooldownUntil = &t
+	}
+
+	for _, m := range s.Metrics {
+		status.Metrics = append(status.Metrics, *m)
+	}
+
+	for _, sc := range s.Schedules {
+		ss := ScheduleStatus{
+			Name:     sc.Name,
+			Cron:     sc.Cron,
+			Duration: sc.Duration.String(),
+			Timezone: sc.Location.String(),
+		}
+		if sc.HasMin {
+			v := sc.MinReplicas
+			ss.MinReplicas = &v
+		}
+		if sc.HasMax {
+			v := sc.MaxReplicas
+			ss.MaxReplicas = &v
+		}
+		status.Schedules = append(status.Schedules, ss)
+	}
+
+	return status
+}
+
+// writeJSON writes v as JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Failed to write API response")
+	}
+}
+
+// writeError writes an error message as JSON response
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
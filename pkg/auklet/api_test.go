@@ -0,0 +1,308 @@
+package auklet
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// request sends a request to the API of the test Auklet, and returns the
+// response
+func (e *testEnv) request(method string, path string, body string) *httptest.ResponseRecorder {
+	return e.serve(httptest.NewRequest(method, path, strings.NewReader(body)))
+}
+
+// serve serves the request with the API of the test Auklet
+func (e *testEnv) serve(r *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	e.a.registerAPIHandlers(router.PathPrefix("/api/v1").Subrouter())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// decode decodes the JSON response into v, failing the test when the
+// response doesn't have the expected status code
+func decode(t *testing.T, w *httptest.ResponseRecorder, code int, v interface{}) {
+	t.Helper()
+	if w.Code != code {
+		t.Fatalf("expected status %d, got %d: %s", code, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON response, got %q", ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+}
+
+func TestAPIListServices(t *testing.T) {
+	e := newTestEnv(t, "api-list-b", 2, nil)
+	e.a.registerService(e.svc)
+	other := e.orchestrator.AddService("api-list-a", 3, nil)
+	e.a.registerService(getInvalidService(e.a, &other, errors.New("invalid")))
+
+	var statuses []map[string]interface{}
+	decode(t, e.request(http.MethodGet, "/api/v1/services", ""), http.StatusOK, &statuses)
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(statuses))
+	}
+
+	// Services are sorted by name
+	if statuses[0]["service_name"] != "api-list-a" || statuses[1]["service_name"] != "api-list-b" {
+		t.Errorf("expected services sorted by name, got %v and %v", statuses[0]["service_name"], statuses[1]["service_name"])
+	}
+
+	s := statuses[1]
+	for key, expected := range map[string]interface{}{
+		"service_id":   e.serviceID,
+		"state":        "stable",
+		"config_valid": true,
+		"mode":         ModeStep,
+		"min_replicas": 1.0,
+		"max_replicas": 10.0,
+		"paused":       false,
+		"dry_run":      false,
+	} {
+		if s[key] != expected {
+			t.Errorf("expected %s to be %v, got %v", key, expected, s[key])
+		}
+	}
+	if _, found := s["config_error"]; found {
+		t.Error("expected no config_error for a valid configuration")
+	}
+	if _, found := s["pinned_replicas"]; found {
+		t.Error("expected no pinned_replicas without an override")
+	}
+	metrics, ok := s["metrics"].([]interface{})
+	if !ok || len(metrics) != 1 {
+		t.Errorf("expected 1 metric, got %v", s["metrics"])
+	}
+}
+
+func TestAPIListServicesEmpty(t *testing.T) {
+	e := newTestEnv(t, "api-list-empty", 2, nil)
+
+	w := e.request(http.MethodGet, "/api/v1/services", "")
+	var statuses []ServiceStatus
+	decode(t, w, http.StatusOK, &statuses)
+	if statuses == nil || len(statuses) != 0 {
+		t.Errorf("expected an empty list, got %s", w.Body.String())
+	}
+}
+
+func TestAPIGetService(t *testing.T) {
+	e := newTestEnv(t, "api-get", 2, nil)
+	e.a.registerService(e.svc)
+
+	for _, id := range []string{e.serviceID, "api-get"} {
+		var status ServiceStatus
+		decode(t, e.request(http.MethodGet, "/api/v1/services/"+id, ""), http.StatusOK, &status)
+		if status.ServiceID != e.serviceID || status.ServiceName != "api-get" {
+			t.Errorf("expected service %s to be found by %q, got %s (%s)", e.serviceID, id, status.ServiceID, status.ServiceName)
+		}
+	}
+}
+
+func TestAPIGetServiceNotFound(t *testing.T) {
+	e := newTestEnv(t, "api-get-not-found", 2, nil)
+	e.a.registerService(e.svc)
+
+	for _, path := range []string{
+		"/api/v1/services/unknown",
+		"/api/v1/services/unknown/history",
+	} {
+		var body map[string]string
+		decode(t, e.request(http.MethodGet, path, ""), http.StatusNotFound, &body)
+		if body["error"] != "service not monitored" {
+			t.Errorf("%s: expected an error message, got %v", path, body)
+		}
+	}
+}
+
+func TestAPIGetServiceConfigError(t *testing.T) {
+	e := newTestEnv(t, "api-config-error", 2, nil)
+	s := e.orchestrator.Services[e.serviceID]
+	e.a.registerService(getInvalidService(e.a, s, errors.New("auklet.scale_min must be a number")))
+
+	var status map[string]interface{}
+	decode(t, e.request(http.MethodGet, "/api/v1/services/"+e.serviceID, ""), http.StatusOK, &status)
+	if status["config_valid"] != false {
+		t.Errorf("expected config_valid to be false, got %v", status["config_valid"])
+	}
+	if status["config_error"] != "auklet.scale_min must be a number" {
+		t.Errorf("expected the configuration error, got %v", status["config_error"])
+	}
+	if status["current_replicas"] != 2.0 {
+		t.Errorf("expected 2 current replicas, got %v", status["current_replicas"])
+	}
+}
+
+func TestAPIPauseAndResume(t *testing.T) {
+	e := newTestEnv(t, "api-pause", 2, nil)
+	e.a.registerService(e.svc)
+
+	var status ServiceStatus
+	decode(t, e.request(http.MethodPost, "/api/v1/services/api-pause/pause", ""), http.StatusOK, &status)
+	if !status.Paused {
+		t.Error("expected the service to be paused")
+	}
+	if !e.a.getControl(e.serviceID).Paused {
+		t.Error("expected the pause to be kept")
+	}
+
+	e.a.pinService(e.serviceID, 3, time.Hour)
+	status = ServiceStatus{}
+	decode(t, e.request(http.MethodPost, "/api/v1/services/api-pause/resume", ""), http.StatusOK, &status)
+	if status.Paused || status.PinnedReplicas != nil {
+		t.Errorf("expected the pause and override to be removed, got %+v", status)
+	}
+}
+
+func TestAPIOverride(t *testing.T) {
+	e := newTestEnv(t, "api-override", 2, nil)
+	e.a.registerService(e.svc)
+
+	var status ServiceStatus
+	decode(t, e.request(http.MethodPost, "/api/v1/services/api-override/override", `{"replicas": 5, "ttl": "1h"}`), http.StatusOK, &status)
+	if status.PinnedReplicas == nil || *status.PinnedReplicas != 5 {
+		t.Fatalf("expected the service to be pinned to 5 replicas, got %v", status.PinnedReplicas)
+	}
+	if until := testStart.Add(time.Hour); !status.PinnedUntil.Equal(until) {
+		t.Errorf("expected the override to expire at %s, got %s", until, status.PinnedUntil)
+	}
+
+	status = ServiceStatus{}
+	decode(t, e.request(http.MethodDelete, "/api/v1/services/api-override/override", ""), http.StatusOK, &status)
+	if status.PinnedReplicas != nil || status.PinnedUntil != nil {
+		t.Errorf("expected the override to be removed, got %v until %v", status.PinnedReplicas, status.PinnedUntil)
+	}
+}
+
+func TestAPIOverrideExpires(t *testing.T) {
+	e := newTestEnv(t, "api-override-expires", 2, nil)
+	e.a.registerService(e.svc)
+
+	var status ServiceStatus
+	decode(t, e.request(http.MethodPost, "/api/v1/services/api-override-expires/override", `{"replicas": 5, "ttl": "10m"}`), http.StatusOK, &status)
+
+	e.clock.Advance(11 * time.Minute)
+	status = ServiceStatus{}
+	decode(t, e.request(http.MethodGet, "/api/v1/services/api-override-expires", ""), http.StatusOK, &status)
+	if status.PinnedReplicas != nil {
+		t.Errorf("expected the override to be expired, got %d replicas", *status.PinnedReplicas)
+	}
+}
+
+func TestAPIOverrideRejectsInvalidRequests(t *testing.T) {
+	e := newTestEnv(t, "api-override-invalid", 2, map[string]string{
+		"auklet.scale_min": "2",
+		"auklet.scale_max": "6",
+	})
+	e.a.registerService(e.svc)
+
+	for _, tc := range []struct {
+		body  string
+		error string
+	}{
+		{`not json`, "invalid request body: "},
+		{`{"replica": 3, "ttl": "1h"}`, `invalid request body: json: unknown field "replica"`},
+		{`{"replicas": "3", "ttl": "1h"}`, "invalid request body: json: cannot unmarshal string"},
+		{`{"ttl": "1h"}`, "replicas must be set"},
+		{`{"replicas": -1, "ttl": "1h"}`, "replicas must be between scale_min (2) and scale_max (6)"},
+		{`{"replicas": 1, "ttl": "1h"}`, "replicas must be between scale_min (2) and scale_max (6)"},
+		{`{"replicas": 7, "ttl": "1h"}`, "replicas must be between scale_min (2) and scale_max (6)"},
+		{`{"replicas": 3}`, "ttl must be set"},
+		{`{"replicas": 3, "ttl": "an hour"}`, "invalid ttl: "},
+		{`{"replicas": 3, "ttl": "0s"}`, "ttl must be positive"},
+		{`{"replicas": 3, "ttl": "-1h"}`, "ttl must be positive"},
+	} {
+		var body map[string]string
+		decode(t, e.request(http.MethodPost, "/api/v1/services/api-override-invalid/override", tc.body), http.StatusBadRequest, &body)
+		if !strings.HasPrefix(body["error"], tc.error) {
+			t.Errorf("%s: expected error %q, got %q", tc.body, tc.error, body["error"])
+		}
+	}
+	if e.a.getControl(e.serviceID).Pinned {
+		t.Error("expected the service not to be pinned")
+	}
+
+	// The bounds are inclusive
+	for _, replicas := range []string{"2", "6"} {
+		var status ServiceStatus
+		decode(t, e.request(http.MethodPost, "/api/v1/services/api-override-invalid/override", `{"replicas": `+replicas+`, "ttl": "1h"}`), http.StatusOK, &status)
+	}
+}
+
+func TestAPIOverrideInvalidConfig(t *testing.T) {
+	e := newTestEnv(t, "api-override-config-error", 2, nil)
+	e.a.registerService(getInvalidService(e.a, e.orchestrator.Services[e.serviceID], errors.New("invalid")))
+
+	var body map[string]string
+	decode(t, e.request(http.MethodPost, "/api/v1/services/api-override-config-error/override", `{"replicas": 3, "ttl": "1h"}`), http.StatusConflict, &body)
+	if e.a.getControl(e.serviceID).Pinned {
+		t.Error("expected the service not to be pinned")
+	}
+}
+
+func TestAPIControlNotFound(t *testing.T) {
+	e := newTestEnv(t, "api-control-not-found", 2, nil)
+	e.a.registerService(e.svc)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/api/v1/services/unknown/pause"},
+		{http.MethodPost, "/api/v1/services/unknown/resume"},
+		{http.MethodPost, "/api/v1/services/unknown/override"},
+		{http.MethodDelete, "/api/v1/services/unknown/override"},
+	} {
+		var body map[string]string
+		decode(t, e.request(tc.method, tc.path, `{"replicas": 3, "ttl": "1h"}`), http.StatusNotFound, &body)
+	}
+	if len(e.a.controls) != 0 {
+		t.Errorf("expected no manual overrides, got %d", len(e.a.controls))
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	e := newTestEnv(t, "api-token", 2, nil)
+	e.a.registerService(e.svc)
+	e.a.APIToken = "secret"
+
+	pause := func(authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/services/api-token/pause", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return e.serve(r)
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		var body map[string]string
+		decode(t, pause(authorization), http.StatusUnauthorized, &body)
+		if body["error"] != "missing or invalid API token" {
+			t.Errorf("%q: expected an error message, got %v", authorization, body)
+		}
+	}
+	if e.a.getControl(e.serviceID).Paused {
+		t.Fatal("expected the service not to be paused without a valid token")
+	}
+
+	var status ServiceStatus
+	decode(t, pause("Bearer secret"), http.StatusOK, &status)
+	if !status.Paused {
+		t.Error("expected the service to be paused")
+	}
+
+	// Inspecting services doesn't need the token
+	decode(t, e.request(http.MethodGet, "/api/v1/services/api-token", ""), http.StatusOK, &status)
+}
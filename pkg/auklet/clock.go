@@ -0,0 +1,48 @@
+package auklet
+
+import (
+	"time"
+)
+
+// Clock provides the current time and timers to Auklet. The state machine and
+// monitors only use the Clock, so grace periods, cooldowns and polling can be
+// driven by FakeClock in tests and simulations.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock backed by the time package
+type RealClock struct{}
+
+// Now implements Clock
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker implements Clock
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// After implements Clock
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// realTicker wraps time.Ticker to implement Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+// C implements Ticker
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
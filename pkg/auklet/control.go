@@ -0,0 +1,113 @@
+package auklet
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// serviceControl holds the manual overrides of autoscaling for a service. It is
+// kept by Auklet instead of the monitor, so it survives monitors being
+// re-created when the service is updated.
+type serviceControl struct {
+	Paused   bool
+	Pinned   bool
+	Replicas int
+	Until    time.Time
+}
+
+// pauseService stops autoscaling of the service until it is resumed
+func (a *Auklet) pauseService(serviceID string) {
+	a.Lock()
+	c := a.control(serviceID)
+	c.Paused = true
+	a.Unlock()
+
+	a.setServiceMetric(serviceID, MetricPaused, 1)
+	log.WithField("service_id", serviceID).Info("Autoscaling paused")
+}
+
+// pinService fixes the number of replicas of the service for duration ttl,
+// during which autoscaling is suspended
+func (a *Auklet) pinService(serviceID string, replicas int, ttl time.Duration) {
+	a.Lock()
+	c := a.control(serviceID)
+	c.Pinned = true
+	c.Replicas = replicas
+	c.Until = a.Clock.Now().Add(ttl)
+	a.Unlock()
+
+	a.setServiceMetric(serviceID, MetricPinned, 1)
+	log.WithFields(log.Fields{
+		"service_id": serviceID,
+		"replicas":   replicas,
+		"ttl":        ttl.String(),
+	}).Info("Service pinned to fixed number of replicas")
+}
+
+// unpinService removes a replica override from the service
+func (a *Auklet) unpinService(serviceID string) {
+	a.Lock()
+	if c, found := a.controls[serviceID]; found {
+		c.Pinned = false
+		a.cleanupControl(serviceID)
+	}
+	a.Unlock()
+
+	a.setServiceMetric(serviceID, MetricPinned, 0)
+	log.WithField("service_id", serviceID).Info("Service replica override removed")
+}
+
+// resumeService removes the pause and replica override from the service
+func (a *Auklet) resumeService(serviceID string) {
+	a.Lock()
+	delete(a.controls, serviceID)
+	a.Unlock()
+
+	a.setServiceMetric(serviceID, MetricPaused, 0)
+	a.setServiceMetric(serviceID, MetricPinned, 0)
+	log.WithField("service_id", serviceID).Info("Autoscaling resumed")
+}
+
+// getControl returns a copy of the current manual overrides of the service.
+// Expired replica overrides are removed.
+func (a *Auklet) getControl(serviceID string) serviceControl {
+	a.Lock()
+	c, found := a.controls[serviceID]
+	if !found {
+		a.Unlock()
+		return serviceControl{}
+	}
+
+	expired := c.Pinned && a.Clock.Now().After(c.Until)
+	if expired {
+		c.Pinned = false
+		a.cleanupControl(serviceID)
+	}
+	control := *c
+	a.Unlock()
+
+	if expired {
+		a.setServiceMetric(serviceID, MetricPinned, 0)
+		log.WithField("service_id", serviceID).Info("Service replica override expired")
+	}
+	return control
+}
+
+// control returns the manual overrides of the service, creating them if
+// necessary. Must be called with the lock held.
+func (a *Auklet) control(serviceID string) *serviceControl {
+	c, found := a.controls[serviceID]
+	if !found {
+		c = &serviceControl{}
+		a.controls[serviceID] = c
+	}
+	return c
+}
+
+// cleanupControl removes the manual overrides of the service when none are
+// in effect anymore. Must be called with the lock held.
+func (a *Auklet) cleanupControl(serviceID string) {
+	if c, found := a.controls[serviceID]; found && !c.Paused && !c.Pinned {
+		delete(a.controls, serviceID)
+	}
+}
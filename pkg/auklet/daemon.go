@@ -4,9 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -23,12 +24,27 @@ import (
 // Auklet contains global state
 type Auklet struct {
 	sync.Mutex
-	DockerClient     *client.Client
-	PrometheusClient *api.Client
-	CancelMonitor    map[string]func()
-	HTTPServer       *http.Server
-	metrics          map[string]prometheus.Metric
-	serviceMetrics   map[string]map[string]prometheus.Metric
+	DockerClient      Orchestrator
+	PrometheusClient  MetricSource
+	CancelMonitor     map[string]func()
+	HTTPServer        *http.Server
+	Clock             Clock
+	DryRun            bool
+	LeaderService     string
+	LeaderIdentity    string
+	LeaseDuration     time.Duration
+	EventsRetryBudget time.Duration
+	Defaults          map[string]string
+	Profiles          map[string]map[string]string
+	HistoryFile       string
+	APIToken          string
+	Notify            Notify
+	decisions         chan Decision
+	metrics           map[string]prometheus.Metric
+	serviceMetrics    map[string]map[string]prometheus.Collector
+	services          map[string]*Service
+	monitorUpdates    map[string]chan swarm.Service
+	controls          map[string]*serviceControl
 }
 
 // New initializes a new Auklet instance for us; it validates required
@@ -58,14 +74,30 @@ func New(promURL string, port int) (*Auklet, error) {
 		return nil, fmt.Errorf("error creating Prometheus client: %v", err)
 	}
 
-	return &Auklet{
-		DockerClient:     dockerClient,
-		PrometheusClient: &promClient,
-		CancelMonitor:    make(map[string]func()),
-		HTTPServer:       NewWebServer(port),
-		metrics:          registerGlobalMetrics(),
-		serviceMetrics:    make(map[string]map[string]prometheus.Metric),
-	}, nil
+	return NewWithClients(dockerClient, v1.NewAPI(promClient), port), nil
+}
+
+// NewWithClients initializes a new Auklet instance that uses the given
+// orchestrator and metric source, e.g. FakeOrchestrator and FakeMetricSource.
+func NewWithClients(orchestrator Orchestrator, metricSource MetricSource, port int) *Auklet {
+	a := &Auklet{
+		DockerClient:      orchestrator,
+		PrometheusClient:  metricSource,
+		CancelMonitor:     make(map[string]func()),
+		Clock:             RealClock{},
+		LeaseDuration:     DefaultLeaseDuration,
+		EventsRetryBudget: DefaultEventsRetryBudget,
+		Notify:            DefaultNotify(),
+		metrics:           registerGlobalMetrics(),
+		serviceMetrics:    make(map[string]map[string]prometheus.Collector),
+		services:          make(map[string]*Service),
+		monitorUpdates:    make(map[string]chan swarm.Service),
+		controls:          make(map[string]*serviceControl),
+		decisions:         make(chan Decision, historyBuffer),
+	}
+	a.HTTPServer = NewWebServer(a, port)
+
+	return a
 }
 
 // Fly actually starts the program, and waits for an OS signal/interrupt
@@ -79,17 +111,25 @@ func (a *Auklet) Fly() error {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
-	services, err := a.getAllServices(ctx)
-	if err != nil {
-		return err
-	}
-
-	for _, s := range services {
-		a.startMonitor(ctx, s)
+	if a.HistoryFile != "" {
+		go a.writeHistory(ctx)
 	}
 
 	errorChan := make(chan error, 1)
-	go a.receiveDockerEvents(ctx, errorChan)
+	if a.LeaderService == "" {
+		// Without leader election this instance always leads
+		a.setLeader(true)
+		if err := a.lead(ctx, errorChan); err != nil {
+			cancel()
+			return err
+		}
+	} else {
+		if a.LeaseDuration <= 0 || a.LeaderIdentity == "" {
+			cancel()
+			return errors.New("leader election requires a lease duration and identity")
+		}
+		go a.runLeaderElection(ctx, errorChan)
+	}
 	go a.startWebServer(ctx)
 
 	select {
@@ -113,9 +153,25 @@ func (a *Auklet) Fly() error {
 	return nil
 }
 
+// lead starts monitoring all services, and listening to Docker events to keep
+// the monitors up to date. Everything is stopped when ctx is cancelled.
+func (a *Auklet) lead(ctx context.Context, errorChan chan error) error {
+	services, err := a.getAllServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		a.startMonitor(ctx, s)
+	}
+
+	go a.receiveDockerEvents(ctx, errorChan)
+	return nil
+}
+
 // NewWebServer returns a new HTTP server configured for serving all Auklet
 // endpoints.
-func NewWebServer(port int) *http.Server {
+func NewWebServer(a *Auklet, port int) *http.Server {
 	// Create a new router
 	router := mux.NewRouter()
 
@@ -132,6 +188,9 @@ func NewWebServer(port int) *http.Server {
 
 	router.Handle("/metrics", promhttp.Handler())
 
+	// Register API handlers
+	a.registerAPIHandlers(router.PathPrefix("/api/v1").Subrouter())
+
 	// By storing the HTTP Server, we are able to Shutdown gracefully..
 	return &http.Server{
 		Addr:           fmt.Sprintf(":%d", port),
@@ -153,4 +212,4 @@ func (a *Auklet) startWebServer(ctx context.Context) {
 	} else {
 		log.WithField("message", err).Info("HTTP Server stopped")
 	}
-}
\ No newline at end of file
+}
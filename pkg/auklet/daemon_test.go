@@ -0,0 +1,256 @@
+package auklet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// waitFor waits until cond holds, for the goroutines started by lead
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// monitored returns the Service registered for the service, or nil
+func (e *testEnv) monitored() *Service {
+	e.a.Lock()
+	defer e.a.Unlock()
+	return e.a.services[e.serviceID]
+}
+
+// tickers returns the number of tickers of the fake clock
+func (e *testEnv) tickers() int {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	return len(e.clock.tickers)
+}
+
+// subscribed returns whether anyone subscribed to the events of the fake
+// orchestrator
+func (e *testEnv) subscribed() bool {
+	e.orchestrator.Lock()
+	defer e.orchestrator.Unlock()
+	return len(e.orchestrator.subscribers) > 0
+}
+
+// lastPoll returns the time of the last successful poll of the service
+func (e *testEnv) lastPoll() time.Time {
+	svc := e.monitored()
+	if svc == nil {
+		return time.Time{}
+	}
+	svc.Lock()
+	defer svc.Unlock()
+	return svc.LastPoll
+}
+
+// tick advances the clock by the polling interval, and waits for the monitor
+// to poll
+func (e *testEnv) tick(interval time.Duration) {
+	e.t.Helper()
+	e.clock.Advance(interval)
+	now := e.clock.Now()
+	waitFor(e.t, "poll", func() bool { return !e.lastPoll().Before(now) })
+}
+
+// update updates the spec of the service like `docker service update`
+func (e *testEnv) update(replicas uint64, labels map[string]string) {
+	e.t.Helper()
+	s, _, err := e.orchestrator.ServiceInspectWithRaw(context.Background(), e.serviceID)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	s.Spec.Mode.Replicated.Replicas = &replicas
+	for k, v := range labels {
+		s.Spec.Labels[k] = v
+	}
+	if _, err := e.orchestrator.ServiceUpdate(context.Background(), s.ID, s.Version, s.Spec, types.ServiceUpdateOptions{}); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func TestLead(t *testing.T) {
+	e := newTestEnv(t, "daemon-lead", 2, map[string]string{"auklet.polling_interval": "10s"})
+	e.metrics.Set("load", 90)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", func() bool { return e.monitored() != nil && e.tickers() == 1 })
+	waitFor(t, "event subscription", e.subscribed)
+	svc := e.monitored()
+
+	// Over threshold: scale up on every poll
+	e.tick(10 * time.Second)
+	waitFor(t, "scale up", func() bool { return e.replicas() == 3 })
+	e.tick(10 * time.Second)
+	waitFor(t, "scale up", func() bool { return e.replicas() == 4 })
+
+	// The update events of Auklet's own scale actions, including its
+	// annotations, don't reconfigure the service
+	if e.monitored() != svc {
+		t.Fatal("expected the service not to be reconfigured by scaling it")
+	}
+
+	// Somebody else scales the service; the next poll starts from there
+	e.metrics.Set("load", 50)
+	e.update(7, nil)
+	e.tick(10 * time.Second)
+	svc.Lock()
+	current := svc.CurrentReplicas
+	svc.Unlock()
+	if current != 7 {
+		t.Errorf("expected 7 current replicas, got %d", current)
+	}
+	e.expectReplicas(7)
+	if e.monitored() != svc {
+		t.Fatal("expected the service not to be reconfigured by a replica change")
+	}
+
+	// Changing the configuration reconfigures the service
+	e.metrics.Set("load", 10)
+	e.update(7, map[string]string{"auklet.down_step": "3"})
+	waitFor(t, "reconfigure", func() bool { return e.monitored() != svc })
+	if n := e.monitored().DownStep; n != 3 {
+		t.Errorf("expected down_step 3, got %d", n)
+	}
+	e.tick(10 * time.Second)
+	waitFor(t, "scale down", func() bool { return e.replicas() == 4 })
+
+	// Disabling autoscaling stops the monitor
+	e.update(4, map[string]string{"auklet.autoscale": "false"})
+	waitFor(t, "monitor stopped", func() bool { return e.monitored() == nil })
+}
+
+func TestLeadRemovedService(t *testing.T) {
+	e := newTestEnv(t, "daemon-remove", 2, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", func() bool { return e.monitored() != nil })
+	waitFor(t, "event subscription", e.subscribed)
+
+	e.orchestrator.RemoveService(e.serviceID)
+	waitFor(t, "monitor stopped", func() bool { return e.monitored() == nil })
+
+	e.a.Lock()
+	defer e.a.Unlock()
+	if _, found := e.a.CancelMonitor[e.serviceID]; found {
+		t.Error("expected the monitor to be deleted")
+	}
+}
+
+func TestLeadCreatedService(t *testing.T) {
+	e := newTestEnv(t, "daemon-create", 2, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "event subscription", e.subscribed)
+
+	s := e.orchestrator.AddService("daemon-create-2", 1, testLabels(nil))
+	waitFor(t, "monitor", func() bool {
+		e.a.Lock()
+		defer e.a.Unlock()
+		return e.a.services[s.ID] != nil
+	})
+}
+
+func TestMonitorPollIntervalChange(t *testing.T) {
+	e := newTestEnv(t, "daemon-interval", 2, map[string]string{"auklet.polling_interval": "10s"})
+	e.metrics.Set("load", 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", func() bool { return e.monitored() != nil && e.tickers() == 1 })
+	waitFor(t, "event subscription", e.subscribed)
+	svc := e.monitored()
+	e.tick(10 * time.Second)
+
+	e.update(2, map[string]string{"auklet.polling_interval": "30s"})
+	waitFor(t, "new ticker", func() bool {
+		e.clock.Lock()
+		defer e.clock.Unlock()
+		return e.monitored() != svc && len(e.clock.tickers) == 1 && e.clock.tickers[0].interval == 30*time.Second
+	})
+
+	// The old ticker was replaced by a single ticker with the new interval,
+	// starting at the time of the update
+	e.clock.Lock()
+	tickers := e.clock.tickers
+	if next := tickers[0].next; !next.Equal(testStart.Add(40 * time.Second)) {
+		t.Errorf("expected the first tick at +40s, got %s", next.Sub(testStart))
+	}
+	e.clock.Unlock()
+
+	e.tick(30 * time.Second)
+	if poll := e.lastPoll(); !poll.Equal(testStart.Add(40 * time.Second)) {
+		t.Errorf("expected a poll at +40s, got %s", poll.Sub(testStart))
+	}
+}
+
+func TestMonitorUnchangedPollIntervalKeepsTicker(t *testing.T) {
+	e := newTestEnv(t, "daemon-interval-kept", 2, map[string]string{"auklet.polling_interval": "10s"})
+	e.metrics.Set("load", 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", func() bool { return e.monitored() != nil && e.tickers() == 1 })
+	waitFor(t, "event subscription", e.subscribed)
+	e.clock.Lock()
+	ticker := e.clock.tickers[0]
+	e.clock.Unlock()
+	svc := e.monitored()
+
+	e.update(2, map[string]string{"auklet.up_step": "2"})
+	waitFor(t, "reconfigure", func() bool { return e.monitored() != svc })
+
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	if len(e.clock.tickers) != 1 || e.clock.tickers[0] != ticker {
+		t.Error("expected the ticker to be kept")
+	}
+}
+
+func TestLeadGlobalService(t *testing.T) {
+	e := newTestEnv(t, "daemon-global", 2, nil)
+	e.orchestrator.Services[e.serviceID].Spec.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", func() bool { return e.monitored() != nil })
+
+	// Global services can't be scaled, so they aren't polled
+	if svc := e.monitored(); svc.ConfigError == "" {
+		t.Error("expected a configuration error")
+	}
+	if n := e.tickers(); n != 0 {
+		t.Errorf("expected no tickers, got %d", n)
+	}
+}
@@ -8,23 +8,96 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
+// Backoff between attempts to reconnect to the Docker event stream
+const (
+	minEventsBackoff = time.Second
+	maxEventsBackoff = 30 * time.Second
+)
+
+// DefaultEventsRetryBudget is the default time Auklet keeps trying to
+// reconnect to the Docker event stream before giving up
+const DefaultEventsRetryBudget = 5 * time.Minute
+
 // receiveDockerEvents listens to the Docker event stream to see if any services
 // are added or updated in the Swarm, and update the internal administration
-// (labels) accordingly.
+// (labels) accordingly. When the event stream fails it reconnects with
+// exponential backoff, and resyncs all services to catch up with events that
+// were missed in the meantime. Only when reconnecting keeps failing for longer
+// than EventsRetryBudget an error is sent to errorChan.
 func (a *Auklet) receiveDockerEvents(ctx context.Context, errorChan chan error) {
+	backoff := minEventsBackoff
+	var failingSince time.Time
+	reconnect := false
+
+	for {
+		subscribed := a.Clock.Now()
+		err := a.streamDockerEvents(ctx, func() {
+			if !reconnect {
+				return
+			}
+			// Only reconnects need a resync; on startup all services were
+			// just fetched.
+			if err := a.resyncMonitors(ctx); err != nil {
+				log.WithError(err).Error("Error while resyncing services")
+			}
+		})
+		reconnect = true
+
+		if ctx.Err() != nil {
+			// The event stream was closed because we stopped (leading)
+			log.Info("Stopping Docker event listener")
+			return
+		}
+
+		// Subscribing never fails by itself; only a stream that stayed up
+		// for a while means reconnecting succeeded.
+		if a.Clock.Now().Sub(subscribed) >= maxEventsBackoff {
+			backoff = minEventsBackoff
+			failingSince = time.Time{}
+		}
+		if failingSince.IsZero() {
+			failingSince = a.Clock.Now()
+		}
+		if a.Clock.Now().Sub(failingSince) > a.EventsRetryBudget {
+			errorChan <- fmt.Errorf("error connecting to Docker: %v", err)
+			return
+		}
+
+		log.WithError(err).WithField("backoff", backoff.String()).Warn("Docker event stream failed; reconnecting")
+		select {
+		case <-a.Clock.After(backoff):
+		case <-ctx.Done():
+			log.Info("Stopping Docker event listener")
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxEventsBackoff {
+			backoff = maxEventsBackoff
+		}
+	}
+}
+
+// streamDockerEvents subscribes to the Docker event stream and handles all
+// service events until the stream fails or ctx is cancelled. onConnect is
+// called once the subscription is set up.
+func (a *Auklet) streamDockerEvents(ctx context.Context, onConnect func()) error {
 	// only subscribe to service events (create, update, remove)
 	eventsFilter := filters.NewArgs()
 	eventsFilter.Add("type", "service")
 
 	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	eventChan, errChan := a.DockerClient.Events(dctx, types.EventsOptions{
 		Filters: eventsFilter,
-		Since:   time.Now().Format(time.RFC3339Nano),
+		Since:   a.Clock.Now().Format(time.RFC3339Nano),
 	})
 	log.Info("Docker event listener started")
+	onConnect()
 
 	for {
 		select {
@@ -39,36 +112,82 @@ func (a *Auklet) receiveDockerEvents(ctx context.Context, errorChan chan error)
 				"event_type":   e.Type,
 			})
 
+			if a.isLeaderService(serviceID, serviceName) {
+				// Renewing the leader lease updates Auklet's own service
+				eventLogger.Debug("Ignore event of leader service")
+				continue
+			}
+
 			eventLogger.Info("Docker service event received")
 
 			switch e.Action {
 			case "remove":
 				eventLogger.Debug("Delete monitor")
-				a.deleteMonitor(serviceID)
+				a.removeMonitor(serviceID)
 
 			case "create":
 				eventLogger.Debug("Add monitor")
 				a.addMonitor(ctx, serviceID)
 
-			// TODO: prevent recreating the monitor due to updates
 			case "update":
-				// Delete and re-create monitor
-				eventLogger.Debug("Re-create monitor")
-				a.deleteMonitor(serviceID)
-				a.addMonitor(ctx, serviceID)
+				eventLogger.Debug("Update monitor")
+				s, err := a.getServiceByID(ctx, serviceID)
+				if err != nil {
+					eventLogger.WithError(err).Error("Error while querying service")
+					continue
+				}
+				a.updateMonitor(ctx, *s)
 			}
 
-		case ee := <-errChan:
-			errorChan <- fmt.Errorf("error connecting to Docker: %v", ee)
+		case err := <-errChan:
+			return err
 
 		case <-ctx.Done():
-			log.Info("Stopping Docker event listener")
-			cancel()
-			return
+			return nil
 		}
 	}
 }
 
+// resyncMonitors fetches all services from the Swarm and brings the monitors
+// up to date: monitors of removed services are deleted, monitors of existing
+// services receive the current version of the service, and monitors for new
+// services are started.
+func (a *Auklet) resyncMonitors(ctx context.Context) error {
+	log.Info("Resyncing services")
+	services, err := a.getAllServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool)
+	for _, s := range services {
+		present[s.ID] = true
+	}
+
+	a.Lock()
+	var removed []string
+	for id := range a.CancelMonitor {
+		if !present[id] {
+			removed = append(removed, id)
+		}
+	}
+	a.Unlock()
+
+	for _, id := range removed {
+		log.WithField("service_id", id).Debug("Delete monitor of removed service")
+		a.removeMonitor(id)
+	}
+
+	for _, s := range services {
+		if a.isLeaderService(s.ID, s.Spec.Name) {
+			continue
+		}
+
+		a.updateMonitor(ctx, s)
+	}
+	return nil
+}
+
 // private function that retrieves service information from Docker Swarm API
 // using the service ID.
 func (a *Auklet) getServiceByID(ctx context.Context, id string) (*swarm.Service, error) {
@@ -104,39 +223,132 @@ func (a *Auklet) getAllServices(ctx context.Context) ([]swarm.Service, error) {
 	}
 
 	for _, s := range services {
-		log.WithFields(log.Fields{
-			"name":     s.Spec.Name,
-			"id":       s.ID,
-			"labels":   s.Spec.Labels,
-			"replicas": *s.Spec.Mode.Replicated.Replicas,
-		}).Info("Found service")
+		fields := log.Fields{
+			"name":   s.Spec.Name,
+			"id":     s.ID,
+			"labels": s.Spec.Labels,
+		}
+		if replicas, ok := serviceReplicas(&s); ok {
+			fields["replicas"] = replicas
+		}
+		log.WithFields(fields).Info("Found service")
 
 	}
 	return services, nil
 }
 
+// serviceReplicas returns the number of replicas of a service. It returns
+// false when the service isn't in replicated mode, e.g. a global service.
+func serviceReplicas(s *swarm.Service) (int, bool) {
+	if s.Spec.Mode.Replicated == nil || s.Spec.Mode.Replicated.Replicas == nil {
+		return 0, false
+	}
+	return int(*s.Spec.Mode.Replicated.Replicas), true
+}
+
+// ScaleOutcome is the result of scaling a service
+type ScaleOutcome string
+
+// Constants representing the outcome of a scale action
+const (
+	// OutcomeApplied means the service was updated
+	OutcomeApplied ScaleOutcome = "applied"
+	// OutcomeDeferred means the service wasn't ready to be scaled; the scale
+	// action is retried on the next poll
+	OutcomeDeferred ScaleOutcome = "deferred"
+	// OutcomeRejected means the service can't be scaled, e.g. because it
+	// isn't in replicated mode
+	OutcomeRejected ScaleOutcome = "rejected"
+	// OutcomeFailed means updating the service failed
+	OutcomeFailed ScaleOutcome = "failed"
+	// OutcomeDryRun means the service wasn't updated because of dry-run
+	OutcomeDryRun ScaleOutcome = "dry_run"
+)
+
+// maxUpdateAttempts bounds the number of attempts to scale a service that is
+// concurrently updated by someone else
+const maxUpdateAttempts = 3
+
+// updateRetryBackoff is the wait before retrying to scale a service that was
+// concurrently updated; it doubles with every retry
+const updateRetryBackoff = 100 * time.Millisecond
+
+// versionConflictError is the message of the error the daemon returns for an
+// update based on an outdated version of a service, e.g. "rpc error: code =
+// Unknown desc = update out of sequence". The Docker client has no typed error
+// for it, so like Docker's own tests the message is matched.
+const versionConflictError = "update out of sequence"
+
+// isVersionConflict returns whether err is Docker rejecting an update that was
+// based on an outdated version of the service
+func isVersionConflict(err error) bool {
+	return strings.Contains(err.Error(), versionConflictError)
+}
+
 // Private function that actually updates the service and sets the required
-// number of replicas.
-func (a *Auklet) scaleService(serviceID string, replicas int) {
-	service, _, err := a.DockerClient.ServiceInspectWithRaw(context.Background(), serviceID)
+// number of replicas. The annotations replace the annotation labels of the
+// service in the same update. When the service was updated by someone else in
+// between, it is inspected again and the update is retried after a short
+// backoff.
+func (a *Auklet) scaleService(ctx context.Context, serviceID string, replicas int, annotations map[string]string) (ScaleOutcome, error) {
+	var outcome ScaleOutcome
+	var err error
+	backoff := updateRetryBackoff
+	for attempt := 1; attempt <= maxUpdateAttempts; attempt++ {
+		outcome, err = a.updateServiceReplicas(ctx, serviceID, replicas, annotations)
+		if err == nil || !isVersionConflict(err) {
+			return outcome, err
+		}
+		if attempt == maxUpdateAttempts {
+			break
+		}
+		log.WithFields(log.Fields{
+			"service_id": serviceID,
+			"attempt":    attempt,
+			"backoff":    backoff.String(),
+		}).Warn("Service was updated concurrently, retrying")
+
+		select {
+		case <-a.Clock.After(backoff):
+		case <-ctx.Done():
+			return OutcomeFailed, ctx.Err()
+		}
+		backoff *= 2
+	}
+	return OutcomeFailed, fmt.Errorf("giving up after %d attempts: %v", maxUpdateAttempts, err)
+}
+
+// updateServiceReplicas performs a single attempt to scale the service, based
+// on its current version
+func (a *Auklet) updateServiceReplicas(ctx context.Context, serviceID string, replicas int, annotations map[string]string) (ScaleOutcome, error) {
+	service, _, err := a.DockerClient.ServiceInspectWithRaw(ctx, serviceID)
 	if err != nil {
-		log.Error(err)
+		return OutcomeFailed, fmt.Errorf("could not inspect service: %v", err)
 	}
 
-	serviceMode := &service.Spec.Mode
-	if serviceMode.Replicated == nil {
-		log.Error("can't scale: service is not replicated mode")
+	currentReplicas, ok := serviceReplicas(&service)
+	if !ok {
+		return OutcomeRejected, errors.New("service is not in replicated mode")
 	}
-	currentReplicas := int(*service.Spec.Mode.Replicated.Replicas)
 	r := uint64(replicas)
-	serviceMode.Replicated.Replicas = &r
+	service.Spec.Mode.Replicated.Replicas = &r
+
+	if service.Spec.Labels == nil {
+		service.Spec.Labels = make(map[string]string)
+	}
+	for label := range annotationLabels {
+		delete(service.Spec.Labels, label)
+	}
+	for label, v := range annotations {
+		service.Spec.Labels[label] = v
+	}
 
 	// Only perform scaling if the service is in a stable/completed state to
 	// prevent race conditions.
-	if service.UpdateStatus.State == swarm.UpdateStateCompleted || a.serviceReady(context.Background(), service.ID, currentReplicas) {
-		response, err := a.DockerClient.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if service.UpdateStatus.State == swarm.UpdateStateCompleted || a.serviceReady(ctx, service.ID, currentReplicas) {
+		response, err := a.DockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
 		if err != nil {
-			log.Error(err)
+			return OutcomeFailed, fmt.Errorf("could not update service: %v", err)
 		}
 
 		for _, warning := range response.Warnings {
@@ -147,14 +359,15 @@ func (a *Auklet) scaleService(serviceID string, replicas int) {
 			"service_id": serviceID,
 			"replicas":   r,
 		}).Info("scaled service")
-
-	} else {
-		log.WithFields(log.Fields{
-			"service_id": serviceID,
-			"state":      service.UpdateStatus.State,
-			"msg":        service.UpdateStatus.Message,
-		}).Info("wait: service not ready to scale")
+		return OutcomeApplied, nil
 	}
+
+	log.WithFields(log.Fields{
+		"service_id": serviceID,
+		"state":      service.UpdateStatus.State,
+		"msg":        service.UpdateStatus.Message,
+	}).Info("wait: service not ready to scale")
+	return OutcomeDeferred, nil
 }
 
 // function to get all *ready* tasks within the service
@@ -176,7 +389,7 @@ func (a *Auklet) serviceReady(ctx context.Context, serviceID string, replicas in
 
 	tasks, err := a.getReadyServiceTasks(ctx, serviceID)
 	if err != nil {
-		serviceLog.Error("error while querying service ready tasks: %v", err)
+		serviceLog.WithError(err).Error("error while querying service ready tasks")
 		return false
 	}
 
@@ -0,0 +1,306 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// conflictingOrchestrator simulates someone else updating the service between
+// Auklet inspecting and updating it, for the first conflicts inspections
+type conflictingOrchestrator struct {
+	*FakeOrchestrator
+	conflicts int
+}
+
+// ServiceInspectWithRaw implements Orchestrator
+func (o *conflictingOrchestrator) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	s, raw, err := o.FakeOrchestrator.ServiceInspectWithRaw(ctx, serviceID)
+	if err == nil && o.conflicts > 0 {
+		o.conflicts--
+		o.Lock()
+		o.Services[s.ID].Version.Index++
+		o.Unlock()
+	}
+	return s, raw, err
+}
+
+// newConflictEnv returns a test environment whose service is concurrently
+// updated during the first conflicts attempts to scale it
+func newConflictEnv(t *testing.T, name string, conflicts int) (*testEnv, *conflictingOrchestrator) {
+	e := newTestEnv(t, name, 2, nil)
+	o := &conflictingOrchestrator{FakeOrchestrator: e.orchestrator, conflicts: conflicts}
+	e.a.DockerClient = o
+	return e, o
+}
+
+// scaleResult is the result of scaleService
+type scaleResult struct {
+	outcome ScaleOutcome
+	err     error
+}
+
+// scaleAsync scales the service in the background, so the test can drive the
+// backoff between retries
+func (e *testEnv) scaleAsync(ctx context.Context, replicas int) <-chan scaleResult {
+	result := make(chan scaleResult, 1)
+	go func() {
+		outcome, err := e.a.scaleService(ctx, e.serviceID, replicas, nil)
+		result <- scaleResult{outcome, err}
+	}()
+	return result
+}
+
+// skipBackoffs fires the timers of the clock as soon as they are waited on,
+// until the returned function is called
+func (e *testEnv) skipBackoffs() func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			e.clock.Lock()
+			var d time.Duration
+			if len(e.clock.timers) > 0 {
+				d = e.clock.timers[0].at.Sub(e.clock.now)
+			}
+			e.clock.Unlock()
+			if d > 0 {
+				e.clock.Advance(d)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestIsVersionConflict(t *testing.T) {
+	for _, tc := range []struct {
+		err      string
+		conflict bool
+	}{
+		// The error of the daemon as returned by the Docker client
+		{"Error response from daemon: rpc error: code = Unknown desc = update out of sequence", true},
+		{"rpc error: code = Unknown desc = update out of sequence", true},
+		{"Error response from daemon: service web not found", false},
+		{"Error response from daemon: rpc error: code = InvalidArgument desc = replicated mode required", false},
+	} {
+		if isVersionConflict(errors.New(tc.err)) != tc.conflict {
+			t.Errorf("%q: expected conflict to be %t", tc.err, tc.conflict)
+		}
+	}
+}
+
+func TestScaleServiceRetriesVersionConflicts(t *testing.T) {
+	e, _ := newConflictEnv(t, "docker-conflict", maxUpdateAttempts-1)
+
+	// The backoff doubles with every retry
+	result := e.scaleAsync(context.Background(), 3)
+	for _, expected := range []time.Duration{updateRetryBackoff, 2 * updateRetryBackoff} {
+		d := e.nextBackoff()
+		if d != expected {
+			t.Fatalf("expected a backoff of %s, got %s", expected, d)
+		}
+		e.clock.Advance(d)
+	}
+
+	r := <-result
+	if r.err != nil || r.outcome != OutcomeApplied {
+		t.Fatalf("expected the scale to be applied, got %s (%v)", r.outcome, r.err)
+	}
+	e.expectReplicas(3)
+}
+
+func TestScaleServiceGivesUpOnVersionConflicts(t *testing.T) {
+	e, _ := newConflictEnv(t, "docker-conflict-give-up", maxUpdateAttempts)
+	defer e.skipBackoffs()()
+
+	outcome, err := e.a.scaleService(context.Background(), e.serviceID, 3, nil)
+	if err == nil || outcome != OutcomeFailed {
+		t.Fatalf("expected the scale to fail, got %s (%v)", outcome, err)
+	}
+	e.expectReplicas(2)
+	if e.orchestrator.Updates != 0 {
+		t.Errorf("expected no updates, got %d", e.orchestrator.Updates)
+	}
+}
+
+func TestScaleServiceCancelledDuringBackoff(t *testing.T) {
+	e, o := newConflictEnv(t, "docker-conflict-cancelled", maxUpdateAttempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := e.scaleAsync(ctx, 3)
+	e.nextBackoff()
+	cancel()
+
+	select {
+	case r := <-result:
+		if r.err != context.Canceled || r.outcome != OutcomeFailed {
+			t.Errorf("expected the scale to be cancelled, got %s (%v)", r.outcome, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scale to stop when cancelled")
+	}
+	if o.conflicts != maxUpdateAttempts-1 {
+		t.Errorf("expected no more attempts after cancelling, got %d", maxUpdateAttempts-o.conflicts)
+	}
+}
+
+func TestScaleServiceWritesAnnotations(t *testing.T) {
+	o := NewFakeOrchestrator()
+	a := NewWithClients(o, NewFakeMetricSource(), 0)
+	s := o.AddService("docker-annotations", 2, map[string]string{
+		"auklet.autoscale":   "true",
+		LastMetricValueLabel: "42",
+	})
+
+	if _, err := a.scaleService(context.Background(), s.ID, 3, map[string]string{LastScaleReasonLabel: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	labels := o.Services[s.ID].Spec.Labels
+	if labels[LastScaleReasonLabel] != "test" {
+		t.Errorf("expected the reason to be written, got %q", labels[LastScaleReasonLabel])
+	}
+	if _, found := labels[LastMetricValueLabel]; found {
+		t.Error("expected the stale metric value to be removed")
+	}
+	if labels["auklet.autoscale"] != "true" {
+		t.Error("expected other labels to be kept")
+	}
+}
+
+// nextBackoff waits for the event listener to wait for reconnecting, and
+// returns how long it waits
+func (e *testEnv) nextBackoff() time.Duration {
+	e.t.Helper()
+	waitFor(e.t, "backoff", func() bool {
+		e.clock.Lock()
+		defer e.clock.Unlock()
+		return len(e.clock.timers) == 1
+	})
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	return e.clock.timers[0].at.Sub(e.clock.now)
+}
+
+// failEvents makes the event stream and all reconnects fail, or stops
+// failing reconnects when err is nil
+func (e *testEnv) failEvents(err error) {
+	e.orchestrator.Lock()
+	e.orchestrator.EventsError = err
+	e.orchestrator.Unlock()
+	if err != nil {
+		e.orchestrator.FailEvents(err)
+	}
+}
+
+func TestReceiveDockerEventsBackoff(t *testing.T) {
+	e := newTestEnv(t, "docker-events-backoff", 2, nil)
+	e.a.EventsRetryBudget = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.a.receiveDockerEvents(ctx, make(chan error, 1))
+	waitFor(t, "event subscription", e.subscribed)
+
+	// The backoff doubles on every failed reconnect, up to 30s
+	e.failEvents(errors.New("connection lost"))
+	for _, expected := range []time.Duration{1, 2, 4, 8, 16, 30, 30} {
+		d := e.nextBackoff()
+		if d != expected*time.Second {
+			t.Fatalf("expected a backoff of %ds, got %s", expected, d)
+		}
+		e.clock.Advance(d)
+	}
+
+	// A reconnect that stays up for 30s resets the backoff
+	d := e.nextBackoff()
+	e.failEvents(nil)
+	e.clock.Advance(d)
+	waitFor(t, "event subscription", e.subscribed)
+	e.clock.Advance(30 * time.Second)
+	e.failEvents(errors.New("connection lost"))
+	if d := e.nextBackoff(); d != time.Second {
+		t.Errorf("expected the backoff to be reset, got %s", d)
+	}
+}
+
+func TestReceiveDockerEventsRetryBudget(t *testing.T) {
+	e := newTestEnv(t, "docker-events-budget", 2, nil)
+	e.a.EventsRetryBudget = 10 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go e.a.receiveDockerEvents(ctx, errs)
+	waitFor(t, "event subscription", e.subscribed)
+
+	// Reconnects at +1s, +3s and +7s are within the budget
+	e.failEvents(errors.New("connection lost"))
+	for i := 0; i < 3; i++ {
+		e.clock.Advance(e.nextBackoff())
+		e.nextBackoff()
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected error within the retry budget: %v", err)
+		default:
+		}
+	}
+
+	// The reconnect at +15s exceeds it
+	e.clock.Advance(e.nextBackoff())
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an error after the retry budget ran out")
+	}
+	if n := e.orchestrator.Subscriptions; n != 5 {
+		t.Errorf("expected 5 subscriptions, got %d", n)
+	}
+}
+
+func TestReceiveDockerEventsResync(t *testing.T) {
+	e := newTestEnv(t, "docker-events-resync", 2, nil)
+	kept := e.orchestrator.AddService("docker-events-resync-kept", 2, testLabels(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.a.lead(ctx, make(chan error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "monitor", e.monitoring)
+	waitFor(t, "event subscription", e.subscribed)
+	keptSvc := func() *Service {
+		e.a.Lock()
+		defer e.a.Unlock()
+		return e.a.services[kept.ID]
+	}
+	waitFor(t, "monitor", func() bool { return keptSvc() != nil })
+	svc := keptSvc()
+
+	// Events missed while disconnected
+	e.orchestrator.FailEvents(errors.New("connection lost"))
+	backoff := e.nextBackoff()
+	e.orchestrator.RemoveService(e.serviceID)
+	created := e.orchestrator.AddService("docker-events-resync-created", 2, testLabels(nil))
+
+	e.clock.Advance(backoff)
+	waitFor(t, "monitor of removed service deleted", func() bool { return !e.monitoring() })
+	waitFor(t, "monitor of created service started", func() bool {
+		e.a.Lock()
+		defer e.a.Unlock()
+		_, found := e.a.CancelMonitor[created.ID]
+		return found
+	})
+	if keptSvc() != svc {
+		t.Error("expected the monitor of an unchanged service to be kept")
+	}
+}
@@ -0,0 +1,449 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/prometheus/common/model"
+	"sync"
+	"time"
+)
+
+// FakeOrchestrator is an in-memory Orchestrator for testing. Services are
+// added with AddService; updates through ServiceUpdate are subject to the same
+// version check as Docker's, and are published as service events to all
+// subscribers.
+type FakeOrchestrator struct {
+	sync.Mutex
+	Services map[string]*swarm.Service
+	// NotReady holds the number of tasks of a service that are not ready
+	NotReady map[string]int
+	Updates  int
+	// EventsError makes new event subscriptions fail at once, like when the
+	// Docker daemon can't be reached
+	EventsError error
+	// Subscriptions is the number of times Events was called
+	Subscriptions int
+	nextID        int
+	subscribers   []*fakeSubscription
+}
+
+// fakeSubscription is a subscription to the events of a FakeOrchestrator
+type fakeSubscription struct {
+	messages chan events.Message
+	errs     chan error
+}
+
+// NewFakeOrchestrator returns an empty FakeOrchestrator
+func NewFakeOrchestrator() *FakeOrchestrator {
+	return &FakeOrchestrator{
+		Services: make(map[string]*swarm.Service),
+		NotReady: make(map[string]int),
+	}
+}
+
+// AddService creates a replicated service, publishes a create event for it and
+// returns it.
+func (f *FakeOrchestrator) AddService(name string, replicas uint64, labels map[string]string) swarm.Service {
+	f.Lock()
+	defer f.Unlock()
+
+	f.nextID++
+	s := swarm.Service{ID: fmt.Sprintf("service%d", f.nextID)}
+	s.Version.Index = 1
+	s.Spec.Name = name
+	s.Spec.Labels = labels
+	s.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+	s.UpdateStatus.State = swarm.UpdateStateCompleted
+
+	f.Services[s.ID] = &s
+	f.publish("create", &s)
+	return copyService(&s)
+}
+
+// RemoveService removes a service and publishes a remove event for it
+func (f *FakeOrchestrator) RemoveService(serviceID string) {
+	f.Lock()
+	defer f.Unlock()
+
+	if s, found := f.Services[serviceID]; found {
+		delete(f.Services, serviceID)
+		f.publish("remove", s)
+	}
+}
+
+// Replicas returns the current number of replicas of a service
+func (f *FakeOrchestrator) Replicas(serviceID string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	if s, found := f.Services[serviceID]; found && s.Spec.Mode.Replicated != nil {
+		return int(*s.Spec.Mode.Replicated.Replicas)
+	}
+	return 0
+}
+
+// ServiceList implements Orchestrator; the id and name filters are supported
+func (f *FakeOrchestrator) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	services := []swarm.Service{}
+	for _, s := range f.Services {
+		if options.Filters.Include("id") && !options.Filters.ExactMatch("id", s.ID) {
+			continue
+		}
+		if options.Filters.Include("name") && !options.Filters.ExactMatch("name", s.Spec.Name) {
+			continue
+		}
+		services = append(services, copyService(s))
+	}
+	return services, nil
+}
+
+// ServiceInspectWithRaw implements Orchestrator; services can be inspected by
+// ID or name
+func (f *FakeOrchestrator) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	s := f.lookup(serviceID)
+	if s == nil {
+		return swarm.Service{}, nil, fmt.Errorf("service %s not found", serviceID)
+	}
+	return copyService(s), nil, nil
+}
+
+// ServiceUpdate implements Orchestrator
+func (f *FakeOrchestrator) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	s := f.lookup(serviceID)
+	if s == nil {
+		return types.ServiceUpdateResponse{}, fmt.Errorf("service %s not found", serviceID)
+	}
+	if s.Version.Index != version.Index {
+		return types.ServiceUpdateResponse{}, errors.New("rpc error: code = Unknown desc = " + versionConflictError)
+	}
+
+	s.Spec = copySpec(service)
+	s.Version.Index++
+	f.Updates++
+	f.publish("update", s)
+	return types.ServiceUpdateResponse{}, nil
+}
+
+// TaskList implements Orchestrator; it returns the ready tasks of the service
+// given by the service filter, which is every replica minus NotReady.
+func (f *FakeOrchestrator) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var tasks []swarm.Task
+	for _, s := range f.Services {
+		if !options.Filters.ExactMatch("service", s.ID) || s.Spec.Mode.Replicated == nil {
+			continue
+		}
+		for i := 0; i < int(*s.Spec.Mode.Replicated.Replicas)-f.NotReady[s.ID]; i++ {
+			tasks = append(tasks, swarm.Task{
+				ID:        fmt.Sprintf("%s.%d", s.ID, i+1),
+				ServiceID: s.ID,
+				Status:    swarm.TaskStatus{State: swarm.TaskStateRunning},
+			})
+		}
+	}
+	return tasks, nil
+}
+
+// Events implements Orchestrator; all service events are published until ctx
+// is cancelled. Filters are ignored.
+func (f *FakeOrchestrator) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.Subscriptions++
+	sub := &fakeSubscription{
+		messages: make(chan events.Message, 100),
+		errs:     make(chan error, 1),
+	}
+	if f.EventsError != nil {
+		sub.errs <- f.EventsError
+		return sub.messages, sub.errs
+	}
+	f.subscribers = append(f.subscribers, sub)
+
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		defer f.Unlock()
+		for i, s := range f.subscribers {
+			if s == sub {
+				f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+				sub.errs <- ctx.Err()
+				break
+			}
+		}
+	}()
+
+	return sub.messages, sub.errs
+}
+
+// FailEvents ends all event subscriptions with err, like when the connection
+// to the Docker daemon is lost
+func (f *FakeOrchestrator) FailEvents(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, s := range f.subscribers {
+		s.errs <- err
+	}
+	f.subscribers = nil
+}
+
+// lookup finds a service by ID or name. Must be called with the lock held.
+func (f *FakeOrchestrator) lookup(serviceID string) *swarm.Service {
+	if s, found := f.Services[serviceID]; found {
+		return s
+	}
+	for _, s := range f.Services {
+		if s.Spec.Name == serviceID {
+			return s
+		}
+	}
+	return nil
+}
+
+// publish sends a service event to all subscribers, dropping it for
+// subscribers that can't keep up. Must be called with the lock held.
+func (f *FakeOrchestrator) publish(action string, s *swarm.Service) {
+	m := events.Message{
+		Type:   "service",
+		Action: action,
+		Actor: events.Actor{
+			ID:         s.ID,
+			Attributes: map[string]string{"name": s.Spec.Name},
+		},
+		Time: time.Now().Unix(),
+	}
+	for _, s := range f.subscribers {
+		select {
+		case s.messages <- m:
+		default:
+		}
+	}
+}
+
+// copyService returns a deep copy of the parts of a service Auklet changes, so
+// callers can't modify the stored service.
+func copyService(s *swarm.Service) swarm.Service {
+	c := *s
+	c.Spec = copySpec(s.Spec)
+	return c
+}
+
+// copySpec returns a deep copy of the labels and replicas of a service spec
+func copySpec(spec swarm.ServiceSpec) swarm.ServiceSpec {
+	c := spec
+	c.Labels = make(map[string]string)
+	for k, v := range spec.Labels {
+		c.Labels[k] = v
+	}
+	if spec.Mode.Replicated != nil && spec.Mode.Replicated.Replicas != nil {
+		r := *spec.Mode.Replicated.Replicas
+		c.Mode.Replicated = &swarm.ReplicatedService{Replicas: &r}
+	}
+	return c
+}
+
+// FakeMetricSource is an in-memory MetricSource for testing. Every query
+// returns the value or error set for it.
+type FakeMetricSource struct {
+	sync.Mutex
+	Values  map[string]model.Value
+	Errors  map[string]error
+	Queries int
+}
+
+// NewFakeMetricSource returns a FakeMetricSource without any values
+func NewFakeMetricSource() *FakeMetricSource {
+	return &FakeMetricSource{
+		Values: make(map[string]model.Value),
+		Errors: make(map[string]error),
+	}
+}
+
+// Set makes the query return a single sample with the given value
+func (f *FakeMetricSource) Set(query string, value float64) {
+	f.SetValue(query, model.Vector{&model.Sample{Value: model.SampleValue(value)}})
+}
+
+// SetValue makes the query return the given value
+func (f *FakeMetricSource) SetValue(query string, value model.Value) {
+	f.Lock()
+	defer f.Unlock()
+	f.Values[query] = value
+	delete(f.Errors, query)
+}
+
+// SetError makes the query fail with the given error
+func (f *FakeMetricSource) SetError(query string, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.Errors[query] = err
+}
+
+// Query implements MetricSource
+func (f *FakeMetricSource) Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.Queries++
+	if err, found := f.Errors[query]; found {
+		return nil, err
+	}
+	if v, found := f.Values[query]; found {
+		return v, nil
+	}
+	return nil, fmt.Errorf("no value for query %q", query)
+}
+
+// FakeClock is a manually driven Clock for testing. Time only moves when
+// Advance or Set is called, firing all tickers and timers that are due in
+// chronological order.
+type FakeClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+// fakeTicker is a Ticker driven by FakeClock
+type fakeTicker struct {
+	clock    *FakeClock
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+// fakeTimer is a timer created by FakeClock.After
+type fakeTimer struct {
+	c  chan time.Time
+	at time.Time
+}
+
+// NewFakeClock returns a FakeClock set to the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTicker{
+		clock:    c,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// After implements Clock
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{c: make(chan time.Time, 1), at: c.now.Add(d)}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock forward to t, firing all tickers and timers that are
+// due on the way in chronological order. Like time.Ticker, ticks are dropped
+// for tickers whose previous tick wasn't received yet.
+func (c *FakeClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	for {
+		var ticker *fakeTicker
+		timer := -1
+		next := t
+
+		for _, tk := range c.tickers {
+			if !tk.next.After(next) {
+				ticker, next = tk, tk.next
+			}
+		}
+		for i, tm := range c.timers {
+			if tm.at.Before(next) || ticker == nil && timer < 0 && tm.at.Equal(next) {
+				ticker, timer, next = nil, i, tm.at
+			}
+		}
+
+		if ticker == nil && timer < 0 {
+			break
+		}
+		if next.After(c.now) {
+			c.now = next
+		}
+
+		if ticker != nil {
+			select {
+			case ticker.c <- next:
+			default:
+			}
+			ticker.next = next.Add(ticker.interval)
+		} else {
+			c.timers[timer].c <- next
+			c.timers = append(c.timers[:timer], c.timers[timer+1:]...)
+		}
+	}
+
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// C implements Ticker
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop implements Ticker
+func (t *fakeTicker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, tk := range t.clock.tickers {
+		if tk == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/prometheus/common/model"
+)
+
+func TestFakeOrchestratorServiceUpdate(t *testing.T) {
+	f := NewFakeOrchestrator()
+	s := f.AddService("web", 2, map[string]string{"auklet.autoscale": "true"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, _ := f.Events(ctx, types.EventsOptions{})
+
+	spec := s.Spec
+	r := uint64(3)
+	spec.Mode.Replicated.Replicas = &r
+	if _, err := f.ServiceUpdate(ctx, s.ID, s.Version, spec, types.ServiceUpdateOptions{}); err != nil {
+		t.Fatalf("ServiceUpdate: %v", err)
+	}
+	if n := f.Replicas(s.ID); n != 3 {
+		t.Errorf("expected 3 replicas, got %d", n)
+	}
+	if f.Updates != 1 {
+		t.Errorf("expected 1 update, got %d", f.Updates)
+	}
+	expectEvent(t, messages, "update", s.ID)
+
+	// The version was bumped by the first update
+	if _, err := f.ServiceUpdate(ctx, s.ID, s.Version, spec, types.ServiceUpdateOptions{}); err == nil || !isVersionConflict(err) {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+	if f.Updates != 1 {
+		t.Errorf("expected a rejected update not to be counted, got %d updates", f.Updates)
+	}
+}
+
+func TestFakeOrchestratorCopiesServices(t *testing.T) {
+	f := NewFakeOrchestrator()
+	s := f.AddService("web", 2, map[string]string{"auklet.autoscale": "true"})
+
+	inspected, _, err := f.ServiceInspectWithRaw(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("ServiceInspectWithRaw: %v", err)
+	}
+	inspected.Spec.Labels["auklet.autoscale"] = "false"
+	*inspected.Spec.Mode.Replicated.Replicas = 5
+
+	if v := f.Services[s.ID].Spec.Labels["auklet.autoscale"]; v != "true" {
+		t.Errorf("expected stored labels to be unchanged, got %q", v)
+	}
+	if n := f.Replicas(s.ID); n != 2 {
+		t.Errorf("expected stored replicas to be unchanged, got %d", n)
+	}
+}
+
+func TestFakeOrchestratorServiceList(t *testing.T) {
+	f := NewFakeOrchestrator()
+	web := f.AddService("web", 1, nil)
+	f.AddService("db", 1, nil)
+
+	all, _ := f.ServiceList(context.Background(), types.ServiceListOptions{})
+	if len(all) != 2 {
+		t.Errorf("expected 2 services, got %d", len(all))
+	}
+
+	byID := filters.NewArgs()
+	byID.Add("id", web.ID)
+	services, _ := f.ServiceList(context.Background(), types.ServiceListOptions{Filters: byID})
+	if len(services) != 1 || services[0].ID != web.ID {
+		t.Errorf("expected only service %s, got %v", web.ID, services)
+	}
+
+	byName := filters.NewArgs()
+	byName.Add("name", "db")
+	services, _ = f.ServiceList(context.Background(), types.ServiceListOptions{Filters: byName})
+	if len(services) != 1 || services[0].Spec.Name != "db" {
+		t.Errorf("expected only service db, got %v", services)
+	}
+}
+
+func TestFakeOrchestratorTaskList(t *testing.T) {
+	f := NewFakeOrchestrator()
+	s := f.AddService("web", 3, nil)
+	f.NotReady[s.ID] = 1
+
+	byService := filters.NewArgs()
+	byService.Add("service", s.ID)
+	tasks, _ := f.TaskList(context.Background(), types.TaskListOptions{Filters: byService})
+	if len(tasks) != 2 {
+		t.Errorf("expected 2 ready tasks, got %d", len(tasks))
+	}
+}
+
+func TestFakeOrchestratorEvents(t *testing.T) {
+	f := NewFakeOrchestrator()
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, errs := f.Events(ctx, types.EventsOptions{})
+
+	s := f.AddService("web", 1, nil)
+	expectEvent(t, messages, "create", s.ID)
+	f.RemoveService(s.ID)
+	expectEvent(t, messages, "remove", s.ID)
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error after cancelling the subscription")
+	}
+
+	// Events after unsubscribing are not delivered
+	f.AddService("db", 1, nil)
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected event after unsubscribing: %v", m)
+	default:
+	}
+}
+
+func TestFakeMetricSource(t *testing.T) {
+	f := NewFakeMetricSource()
+	ctx := context.Background()
+
+	if _, err := f.Query(ctx, "unknown", time.Time{}); err == nil {
+		t.Error("expected an error for an unknown query")
+	}
+
+	f.Set("load", 42)
+	v, err := f.Query(ctx, "load", time.Time{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if vector, ok := v.(model.Vector); !ok || len(vector) != 1 || vector[0].Value != 42 {
+		t.Errorf("expected a single sample of 42, got %v", v)
+	}
+
+	boom := errors.New("boom")
+	f.SetError("load", boom)
+	if _, err := f.Query(ctx, "load", time.Time{}); err != boom {
+		t.Errorf("expected the error set for the query, got %v", err)
+	}
+
+	// Setting a value clears the error
+	f.Set("load", 1)
+	if _, err := f.Query(ctx, "load", time.Time{}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if f.Queries != 4 {
+		t.Errorf("expected 4 queries, got %d", f.Queries)
+	}
+}
+
+func TestFakeClockSetFiresInOrder(t *testing.T) {
+	c := NewFakeClock(testStart)
+	ticker := c.NewTicker(10 * time.Second)
+	late := c.After(15 * time.Second)
+	early := c.After(5 * time.Second)
+
+	c.Set(testStart.Add(25 * time.Second))
+	if now := c.Now(); !now.Equal(testStart.Add(25 * time.Second)) {
+		t.Errorf("expected the clock at +25s, got %s", now.Sub(testStart))
+	}
+
+	// Timers receive the time they were due, not the time the clock was set to
+	expectTime(t, "early timer", early, testStart.Add(5*time.Second))
+	expectTime(t, "late timer", late, testStart.Add(15*time.Second))
+
+	// The tick at +20s was dropped, like time.Ticker does for slow receivers
+	expectTime(t, "first tick", ticker.C(), testStart.Add(10*time.Second))
+	expectNoTime(t, "second tick", ticker.C())
+
+	// Ticks stay aligned to the interval
+	c.Set(testStart.Add(30 * time.Second))
+	expectTime(t, "third tick", ticker.C(), testStart.Add(30*time.Second))
+}
+
+func TestFakeClockSetTimerBeforeTick(t *testing.T) {
+	c := NewFakeClock(testStart)
+	ticker := c.NewTicker(10 * time.Second)
+	timer := c.After(10 * time.Second)
+
+	// A timer and tick due at the same time both fire
+	c.Advance(10 * time.Second)
+	expectTime(t, "tick", ticker.C(), testStart.Add(10*time.Second))
+	expectTime(t, "timer", timer, testStart.Add(10*time.Second))
+}
+
+func TestFakeClockNeverMovesBack(t *testing.T) {
+	c := NewFakeClock(testStart)
+	ticker := c.NewTicker(time.Second)
+
+	c.Set(testStart.Add(-time.Minute))
+	if now := c.Now(); !now.Equal(testStart) {
+		t.Errorf("expected the clock to stay at the start, got %s", now.Sub(testStart))
+	}
+	expectNoTime(t, "tick", ticker.C())
+}
+
+func TestFakeClockAfterZero(t *testing.T) {
+	c := NewFakeClock(testStart)
+	expectTime(t, "timer", c.After(0), testStart)
+}
+
+func TestFakeClockTickerStop(t *testing.T) {
+	c := NewFakeClock(testStart)
+	ticker := c.NewTicker(time.Second)
+	ticker.Stop()
+
+	c.Advance(time.Minute)
+	expectNoTime(t, "tick", ticker.C())
+}
+
+// expectEvent fails the test when the next event isn't the given action on
+// the given service
+func expectEvent(t *testing.T, messages <-chan events.Message, action string, serviceID string) {
+	t.Helper()
+	select {
+	case m := <-messages:
+		if m.Action != action || m.Actor.ID != serviceID {
+			t.Errorf("expected %s event for %s, got %s event for %s", action, serviceID, m.Action, m.Actor.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected %s event for %s", action, serviceID)
+	}
+}
+
+// expectTime fails the test when c doesn't hold the given time
+func expectTime(t *testing.T, name string, c <-chan time.Time, expected time.Time) {
+	t.Helper()
+	select {
+	case v := <-c:
+		if !v.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", name, expected.Sub(testStart), v.Sub(testStart))
+		}
+	default:
+		t.Errorf("%s: expected %s, got nothing", name, expected.Sub(testStart))
+	}
+}
+
+// expectNoTime fails the test when c holds a time
+func expectNoTime(t *testing.T, name string, c <-chan time.Time) {
+	t.Helper()
+	select {
+	case v := <-c:
+		t.Errorf("%s: expected nothing, got %s", name, v.Sub(testStart))
+	default:
+	}
+}
+
+func TestFakeOrchestratorFailEvents(t *testing.T) {
+	f := NewFakeOrchestrator()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, errs := f.Events(ctx, types.EventsOptions{})
+
+	boom := errors.New("boom")
+	f.FailEvents(boom)
+	if err := <-errs; err != boom {
+		t.Errorf("expected the injected error, got %v", err)
+	}
+	f.AddService("web", 1, nil)
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected event after failing: %v", m)
+	default:
+	}
+
+	// New subscriptions fail at once while EventsError is set
+	f.EventsError = boom
+	if _, errs := f.Events(ctx, types.EventsOptions{}); <-errs != boom {
+		t.Error("expected the subscription to fail")
+	}
+	f.EventsError = nil
+	messages, _ = f.Events(ctx, types.EventsOptions{})
+	s := f.AddService("db", 1, nil)
+	expectEvent(t, messages, "create", s.ID)
+	if f.Subscriptions != 3 {
+		t.Errorf("expected 3 subscriptions, got %d", f.Subscriptions)
+	}
+}
@@ -0,0 +1,107 @@
+package auklet
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testStart is the time the fake clock of a test environment starts at
+var testStart = time.Date(2018, 12, 3, 12, 0, 0, 0, time.UTC)
+
+// testEnv is an Auklet running against the fakes, with a single service
+type testEnv struct {
+	t            *testing.T
+	a            *Auklet
+	orchestrator *FakeOrchestrator
+	metrics      *FakeMetricSource
+	clock        *FakeClock
+	serviceID    string
+	svc          *Service
+}
+
+// newTestEnv creates a service with the given number of replicas, and labels
+// on top of a minimal step mode configuration querying "load". Service
+// metrics are shared by all tests, so every test uses its own service name.
+func newTestEnv(t *testing.T, name string, replicas uint64, labels map[string]string) *testEnv {
+	t.Helper()
+
+	e := &testEnv{
+		t:            t,
+		orchestrator: NewFakeOrchestrator(),
+		metrics:      NewFakeMetricSource(),
+		clock:        NewFakeClock(testStart),
+	}
+	e.a = NewWithClients(e.orchestrator, e.metrics, 0)
+	e.a.Clock = e.clock
+
+	s := e.orchestrator.AddService(name, replicas, testLabels(labels))
+	e.serviceID = s.ID
+	svc, err := getService(e.a, &s)
+	if err != nil {
+		t.Fatalf("getService: %v", err)
+	}
+	e.svc = svc
+	if err := e.a.createServiceMetrics(s.ID, s.Spec.Name); err != nil {
+		t.Fatalf("createServiceMetrics: %v", err)
+	}
+	return e
+}
+
+// testLabels returns a minimal valid configuration, overridden by labels
+func testLabels(labels map[string]string) map[string]string {
+	l := map[string]string{
+		"auklet.autoscale":      "true",
+		"auklet.scale_min":      "1",
+		"auklet.scale_max":      "10",
+		"auklet.query":          "load",
+		"auklet.up_threshold":   "80",
+		"auklet.down_threshold": "20",
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+// poll polls the service once
+func (e *testEnv) poll() {
+	e.a.pollService(context.Background(), e.svc, log.NewEntry(log.StandardLogger()))
+}
+
+// pollAfter advances the clock by d, and polls the service
+func (e *testEnv) pollAfter(d time.Duration) {
+	e.clock.Advance(d)
+	e.poll()
+}
+
+// replicas returns the number of replicas of the service in the fake
+// orchestrator
+func (e *testEnv) replicas() int {
+	return e.orchestrator.Replicas(e.serviceID)
+}
+
+// expectReplicas fails the test when the service doesn't have n replicas
+func (e *testEnv) expectReplicas(n int) {
+	e.t.Helper()
+	if r := e.replicas(); r != n {
+		e.t.Fatalf("expected %d replicas, got %d", n, r)
+	}
+}
+
+// expectState fails the test when the service isn't in the given state
+func (e *testEnv) expectState(state serviceState) {
+	e.t.Helper()
+	if e.svc.state != state {
+		e.t.Fatalf("expected state %s, got %s", state, e.svc.state)
+	}
+}
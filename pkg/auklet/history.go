@@ -0,0 +1,127 @@
+package auklet
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// maxDecisions is the number of decisions kept in the history of a Service
+const maxDecisions = 100
+
+// historyBuffer is the number of decisions that can wait to be written to the
+// history file, before new decisions are dropped
+const historyBuffer = 1000
+
+// Decision is a single decision made by the state machine of a Service: a
+// state transition and/or a scale action, together with the metric values it
+// was based on.
+type Decision struct {
+	Time         time.Time    `json:"time"`
+	ServiceID    string       `json:"service_id"`
+	ServiceName  string       `json:"service_name"`
+	Metrics      []Metric     `json:"metrics"`
+	Driver       string       `json:"driver,omitempty"`
+	FromState    string       `json:"from_state"`
+	ToState      string       `json:"to_state"`
+	FromReplicas int          `json:"from_replicas"`
+	ToReplicas   int          `json:"to_replicas"`
+	Outcome      ScaleOutcome `json:"outcome,omitempty"`
+}
+
+// recordDecision adds a decision to the bounded history of the service when
+// the state changed or a scale action was taken during the last poll, and
+// queues it for the history file when configured. It's called with the
+// service locked, so the file is written by writeHistory instead.
+func (s *Service) recordDecision(fromState serviceState) {
+	if s.state == fromState && s.outcome == "" {
+		return
+	}
+
+	d := Decision{
+		Time:         s.auklet.Clock.Now(),
+		ServiceID:    s.ServiceID,
+		ServiceName:  s.ServiceName,
+		Driver:       s.Driver,
+		FromState:    fromState.String(),
+		ToState:      s.state.String(),
+		FromReplicas: s.CurrentReplicas,
+		ToReplicas:   s.DesiredReplicas,
+		Outcome:      s.outcome,
+	}
+	for _, m := range s.Metrics {
+		d.Metrics = append(d.Metrics, *m)
+	}
+
+	s.History = append(s.History, d)
+	if len(s.History) > maxDecisions {
+		s.History = s.History[len(s.History)-maxDecisions:]
+	}
+
+	if s.auklet.HistoryFile != "" {
+		select {
+		case s.auklet.decisions <- d:
+		default:
+			log.WithField("service_id", s.ServiceID).Warn("History file is falling behind; decision not written")
+		}
+	}
+}
+
+// lastDecision returns the last decision in the history of the service, if
+// any. Must be called with the service locked.
+func (s *Service) lastDecision() *Decision {
+	if len(s.History) == 0 {
+		return nil
+	}
+	d := s.History[len(s.History)-1]
+	return &d
+}
+
+// writeHistory appends all recorded decisions to the history file until ctx
+// is cancelled, after which the decisions still queued are written.
+func (a *Auklet) writeHistory(ctx context.Context) {
+	for {
+		select {
+		case d := <-a.decisions:
+			a.writeDecision(d)
+		case <-ctx.Done():
+			for {
+				select {
+				case d := <-a.decisions:
+					a.writeDecision(d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeDecision appends the decision as a JSON line to the history file
+func (a *Auklet) writeDecision(d Decision) {
+	line, err := json.Marshal(d)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode decision")
+		return
+	}
+
+	f, err := os.OpenFile(a.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.WithError(err).Error("Failed to open history file")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Error("Failed to write history file")
+	}
+}
+
+// history returns a copy of the decision history of the service
+func (s *Service) history() []Decision {
+	s.Lock()
+	defer s.Unlock()
+	return append([]Decision{}, s.History...)
+}
@@ -0,0 +1,194 @@
+package auklet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readHistoryFile returns the decisions in the history file
+func readHistoryFile(t *testing.T, path string) []Decision {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var decisions []Decision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// historyFile configures a history file in a temporary directory, and returns
+// its path
+func (e *testEnv) historyFile() string {
+	dir, err := ioutil.TempDir("", "auklet")
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.t.Cleanup(func() { os.RemoveAll(dir) })
+	e.a.HistoryFile = filepath.Join(dir, "history.jsonl")
+	return e.a.HistoryFile
+}
+
+func TestRecordDecision(t *testing.T) {
+	e := newTestEnv(t, "history-record", 2, map[string]string{"auklet.up_graceperiod": "1m"})
+	e.metrics.Set("load", 50)
+
+	// Polls without a change of state or a scale action aren't recorded
+	e.poll()
+	if n := len(e.svc.History); n != 0 {
+		t.Fatalf("expected no decisions, got %d", n)
+	}
+
+	e.metrics.Set("load", 90)
+	e.pollAfter(30 * time.Second)
+	e.pollAfter(time.Minute)
+	h := e.svc.History
+	if len(h) != 2 {
+		t.Fatalf("expected 2 decisions, got %d", len(h))
+	}
+	if h[0].FromState != "stable" || h[0].ToState != "over_threshold" || h[0].Outcome != "" {
+		t.Errorf("expected a change of state without a scale action, got %+v", h[0])
+	}
+	if h[1].FromReplicas != 2 || h[1].ToReplicas != 3 || h[1].Outcome != OutcomeApplied {
+		t.Errorf("expected a 2 -> 3 scale action, got %+v", h[1])
+	}
+	if h[1].Driver != "default" || len(h[1].Metrics) != 1 || h[1].Metrics[0].Value != 90 {
+		t.Errorf("expected the metric values of the decision, got %+v", h[1])
+	}
+	if !h[1].Time.Equal(testStart.Add(90 * time.Second)) {
+		t.Errorf("expected the decision at the time of the poll, got %s", h[1].Time)
+	}
+}
+
+func TestRecordDecisionCap(t *testing.T) {
+	e := newTestEnv(t, "history-cap", 2, nil)
+
+	for i := 0; i < maxDecisions+20; i++ {
+		e.clock.Advance(time.Second)
+		e.svc.outcome = OutcomeDryRun
+		e.svc.recordDecision(StateStable)
+	}
+
+	h := e.svc.history()
+	if len(h) != maxDecisions {
+		t.Fatalf("expected %d decisions, got %d", maxDecisions, len(h))
+	}
+	// The oldest decisions are dropped
+	if first := testStart.Add(21 * time.Second); !h[0].Time.Equal(first) {
+		t.Errorf("expected the first decision at %s, got %s", first, h[0].Time)
+	}
+	if last := testStart.Add(120 * time.Second); !h[len(h)-1].Time.Equal(last) {
+		t.Errorf("expected the last decision at %s, got %s", last, h[len(h)-1].Time)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	e := newTestEnv(t, "history-file", 2, nil)
+	path := e.historyFile()
+
+	// Decisions are appended to an existing file
+	existing := Decision{ServiceName: "other", Outcome: OutcomeApplied}
+	line, _ := json.Marshal(existing)
+	if err := ioutil.WriteFile(path, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.a.writeHistory(ctx)
+
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.pollAfter(30 * time.Second)
+
+	var decisions []Decision
+	waitFor(t, "history file", func() bool {
+		decisions = readHistoryFile(t, path)
+		return len(decisions) == 3
+	})
+	if decisions[0].ServiceName != "other" {
+		t.Errorf("expected the existing decision to be kept, got %+v", decisions[0])
+	}
+	for i, replicas := range []int{3, 4} {
+		d := decisions[i+1]
+		if d.ServiceID != e.serviceID || d.ServiceName != "history-file" || d.ToReplicas != replicas {
+			t.Errorf("expected a decision to scale to %d replicas, got %+v", replicas, d)
+		}
+	}
+}
+
+func TestWriteHistoryOnShutdown(t *testing.T) {
+	e := newTestEnv(t, "history-shutdown", 2, nil)
+	path := e.historyFile()
+
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.pollAfter(30 * time.Second)
+	if n := len(readHistoryFile(t, path)); n != 0 {
+		t.Fatalf("expected decisions to be written by writeHistory only, got %d", n)
+	}
+
+	// Queued decisions are written when shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.a.writeHistory(ctx)
+	if n := len(readHistoryFile(t, path)); n != 2 {
+		t.Errorf("expected 2 decisions, got %d", n)
+	}
+}
+
+func TestHistoryFileFallingBehind(t *testing.T) {
+	e := newTestEnv(t, "history-falling-behind", 2, nil)
+	e.historyFile()
+
+	// Without a writer the queue fills up, but polls never block
+	for i := 0; i < historyBuffer+10; i++ {
+		e.svc.outcome = OutcomeDryRun
+		e.svc.recordDecision(StateStable)
+	}
+	if n := len(e.a.decisions); n != historyBuffer {
+		t.Errorf("expected %d queued decisions, got %d", historyBuffer, n)
+	}
+}
+
+func TestAPIServiceHistory(t *testing.T) {
+	e := newTestEnv(t, "history-api", 2, map[string]string{"auklet.dry_run": "true"})
+	e.a.registerService(e.svc)
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.metrics.Set("load", 10)
+	e.pollAfter(30 * time.Second)
+
+	var decisions []Decision
+	decode(t, e.request(http.MethodGet, "/api/v1/services/history-api/history", ""), http.StatusOK, &decisions)
+	if len(decisions) != 2 {
+		t.Fatalf("expected 2 decisions, got %d", len(decisions))
+	}
+
+	// Oldest decision first
+	if d := decisions[0]; d.ToReplicas != 3 || d.Outcome != OutcomeDryRun || d.Metrics[0].Value != 90 {
+		t.Errorf("expected a dry-run decision to scale up, got %+v", d)
+	}
+	if d := decisions[1]; d.ToReplicas != 1 || d.Outcome != OutcomeDryRun || d.Metrics[0].Value != 10 {
+		t.Errorf("expected a dry-run decision to scale down, got %+v", d)
+	}
+}
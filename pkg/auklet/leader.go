@@ -0,0 +1,181 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Labels on Auklet's own service that hold the leader lease
+const (
+	LeaderLabel        = "auklet.leader"
+	LeaderRenewedLabel = "auklet.leader_renewed"
+)
+
+// DefaultLeaseDuration is the default time a leader lease is valid without
+// being renewed
+const DefaultLeaseDuration = 15 * time.Second
+
+// errLeaseHeld is returned when another instance holds a valid lease
+var errLeaseHeld = errors.New("lease held by another instance")
+
+// runLeaderElection competes for the leader lease stored in the labels of
+// Auklet's own service (LeaderService). Only while this instance holds the
+// lease are services monitored; when the lease is lost all monitors are
+// stopped so another instance can take over.
+func (a *Auklet) runLeaderElection(ctx context.Context, errorChan chan error) {
+	electionLogger := log.WithFields(log.Fields{
+		"leader_service":  a.LeaderService,
+		"leader_identity": a.LeaderIdentity,
+	})
+	electionLogger.Info("Leader election started")
+
+	var leaderCtx context.Context
+	var stopLeading func()
+	var renewed time.Time
+
+	// Renew well within the lease duration, so the lease doesn't expire on
+	// a single failed renewal
+	timer := a.Clock.NewTicker(a.LeaseDuration / 3)
+	defer timer.Stop()
+
+	for {
+		err := a.acquireLease(ctx)
+		switch {
+		case err == nil:
+			renewed = a.Clock.Now()
+			if stopLeading == nil {
+				electionLogger.Info("Acquired leadership")
+				leaderCtx, stopLeading = context.WithCancel(ctx)
+				a.setLeader(true)
+				if err := a.lead(leaderCtx, errorChan); err != nil {
+					electionLogger.WithError(err).Error("Failed to start leading")
+					a.stepDown(stopLeading)
+					stopLeading = nil
+				}
+			}
+
+		case err == errLeaseHeld:
+			if stopLeading != nil {
+				electionLogger.Warn("Lost leadership")
+				a.stepDown(stopLeading)
+				stopLeading = nil
+			}
+
+		default:
+			electionLogger.WithError(err).Error("Error while acquiring leader lease")
+			// The lease can't be renewed; step down well before another
+			// instance can take over.
+			if stopLeading != nil && a.Clock.Now().Sub(renewed) >= a.stepDownAfter() {
+				electionLogger.Warn("Lost leadership; lease about to expire")
+				a.stepDown(stopLeading)
+				stopLeading = nil
+			}
+		}
+
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			if stopLeading != nil {
+				a.stepDown(stopLeading)
+				// Release the lease so another instance can take over
+				// without waiting for it to expire.
+				rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				if err := a.releaseLease(rctx); err != nil {
+					electionLogger.WithError(err).Error("Error while releasing leader lease")
+				}
+				cancel()
+			}
+			electionLogger.Info("Leader election stopped")
+			return
+		}
+	}
+}
+
+// stepDownAfter returns how long a leader keeps leading without renewing its
+// lease. It steps down a third of the lease duration before the lease expires
+// and another instance can take over. This margin covers the time it takes to
+// stop the monitors, and clock skew between the nodes, which is assumed to be
+// well below a third of the lease duration.
+func (a *Auklet) stepDownAfter() time.Duration {
+	return a.LeaseDuration - a.LeaseDuration/3
+}
+
+// acquireLease tries to acquire or renew the leader lease. Docker's version
+// check on service updates guarantees that only one of the competing instances
+// succeeds. errLeaseHeld is returned when another instance holds a valid lease.
+func (a *Auklet) acquireLease(ctx context.Context) error {
+	service, _, err := a.DockerClient.ServiceInspectWithRaw(ctx, a.LeaderService)
+	if err != nil {
+		return fmt.Errorf("could not inspect leader service: %v", err)
+	}
+
+	holder := service.Spec.Labels[LeaderLabel]
+	if holder != "" && holder != a.LeaderIdentity {
+		renewed, err := time.Parse(time.RFC3339Nano, service.Spec.Labels[LeaderRenewedLabel])
+		if err == nil && a.Clock.Now().Sub(renewed) < a.LeaseDuration {
+			return errLeaseHeld
+		}
+	}
+
+	if service.Spec.Labels == nil {
+		service.Spec.Labels = make(map[string]string)
+	}
+	service.Spec.Labels[LeaderLabel] = a.LeaderIdentity
+	service.Spec.Labels[LeaderRenewedLabel] = a.Clock.Now().Format(time.RFC3339Nano)
+
+	_, err = a.DockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		if holder != a.LeaderIdentity {
+			// Most likely another instance updated the service first
+			return errLeaseHeld
+		}
+		return fmt.Errorf("could not update leader lease: %v", err)
+	}
+	return nil
+}
+
+// releaseLease removes the leader lease from the service, if this instance
+// still holds it.
+func (a *Auklet) releaseLease(ctx context.Context) error {
+	service, _, err := a.DockerClient.ServiceInspectWithRaw(ctx, a.LeaderService)
+	if err != nil {
+		return fmt.Errorf("could not inspect leader service: %v", err)
+	}
+	if service.Spec.Labels[LeaderLabel] != a.LeaderIdentity {
+		return nil
+	}
+
+	delete(service.Spec.Labels, LeaderLabel)
+	delete(service.Spec.Labels, LeaderRenewedLabel)
+	_, err = a.DockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	return err
+}
+
+// stepDown stops leading by cancelling the leader context and removing all
+// monitors.
+func (a *Auklet) stepDown(stopLeading func()) {
+	stopLeading()
+	a.deleteAllMonitors()
+	a.setLeader(false)
+}
+
+// setLeader exposes whether this instance is the leader
+func (a *Auklet) setLeader(leader bool) {
+	v := 0.0
+	if leader {
+		v = 1
+	}
+	a.Lock()
+	a.metrics[MetricLeader].(prometheus.Gauge).Set(v)
+	a.Unlock()
+}
+
+// isLeaderService returns true when the given service holds the leader lease
+func (a *Auklet) isLeaderService(serviceID string, serviceName string) bool {
+	return a.LeaderService != "" && (a.LeaderService == serviceID || a.LeaderService == serviceName)
+}
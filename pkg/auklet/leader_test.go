@@ -0,0 +1,245 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// failingOrchestrator fails to inspect services while failing is set
+type failingOrchestrator struct {
+	*FakeOrchestrator
+	mu       sync.Mutex
+	failing  bool
+	failures int
+}
+
+// ServiceInspectWithRaw implements Orchestrator
+func (o *failingOrchestrator) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failing {
+		o.failures++
+		return swarm.Service{}, nil, errors.New("docker unavailable")
+	}
+	return o.FakeOrchestrator.ServiceInspectWithRaw(ctx, serviceID)
+}
+
+func (o *failingOrchestrator) setFailing(failing bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failing = failing
+}
+
+func (o *failingOrchestrator) getFailures() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.failures
+}
+
+// newLeaderEnv returns a test environment with leader election on the auklet
+// service, holding the given lease labels
+func newLeaderEnv(t *testing.T, name string, lease map[string]string) *testEnv {
+	e := newTestEnv(t, name, 2, nil)
+	e.orchestrator.AddService(name+"-auklet", 2, lease)
+	e.a.LeaderService = name + "-auklet"
+	e.a.LeaderIdentity = "me"
+	return e
+}
+
+// lease returns the holder of the lease, and when it was renewed
+func (e *testEnv) lease() (string, string) {
+	s, _, err := e.orchestrator.ServiceInspectWithRaw(context.Background(), e.a.LeaderService)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return s.Spec.Labels[LeaderLabel], s.Spec.Labels[LeaderRenewedLabel]
+}
+
+// monitoring returns whether the service is monitored
+func (e *testEnv) monitoring() bool {
+	e.a.Lock()
+	defer e.a.Unlock()
+	_, found := e.a.CancelMonitor[e.serviceID]
+	return found
+}
+
+func renewedAt(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func TestAcquireLeaseFree(t *testing.T) {
+	e := newLeaderEnv(t, "leader-free", nil)
+
+	if err := e.a.acquireLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if holder, renewed := e.lease(); holder != "me" || renewed != renewedAt(testStart) {
+		t.Errorf("expected the lease to be held by me since the start, got %q at %q", holder, renewed)
+	}
+}
+
+func TestAcquireLeaseExpired(t *testing.T) {
+	e := newLeaderEnv(t, "leader-expired", map[string]string{
+		LeaderLabel:        "other",
+		LeaderRenewedLabel: renewedAt(testStart.Add(-DefaultLeaseDuration)),
+	})
+
+	if err := e.a.acquireLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := e.lease(); holder != "me" {
+		t.Errorf("expected to take over the lease, held by %q", holder)
+	}
+}
+
+func TestAcquireLeaseHeld(t *testing.T) {
+	renewed := renewedAt(testStart.Add(-DefaultLeaseDuration + time.Second))
+	e := newLeaderEnv(t, "leader-held", map[string]string{
+		LeaderLabel:        "other",
+		LeaderRenewedLabel: renewed,
+	})
+
+	if err := e.a.acquireLease(context.Background()); err != errLeaseHeld {
+		t.Fatalf("expected errLeaseHeld, got %v", err)
+	}
+	if holder, r := e.lease(); holder != "other" || r != renewed {
+		t.Errorf("expected the lease to be untouched, got %q at %q", holder, r)
+	}
+	if e.orchestrator.Updates != 0 {
+		t.Errorf("expected no updates, got %d", e.orchestrator.Updates)
+	}
+}
+
+func TestAcquireLeaseRenew(t *testing.T) {
+	e := newLeaderEnv(t, "leader-renew", map[string]string{
+		LeaderLabel:        "me",
+		LeaderRenewedLabel: renewedAt(testStart.Add(-time.Second)),
+	})
+
+	if err := e.a.acquireLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, renewed := e.lease(); renewed != renewedAt(testStart) {
+		t.Errorf("expected the lease to be renewed, got %q", renewed)
+	}
+}
+
+func TestAcquireLeaseLosesRace(t *testing.T) {
+	e := newLeaderEnv(t, "leader-race", nil)
+	// Another instance takes the lease between inspecting and updating
+	e.a.DockerClient = &conflictingOrchestrator{FakeOrchestrator: e.orchestrator, conflicts: 1}
+
+	if err := e.a.acquireLease(context.Background()); err != errLeaseHeld {
+		t.Fatalf("expected errLeaseHeld, got %v", err)
+	}
+	if holder, _ := e.lease(); holder != "" {
+		t.Errorf("expected the lease not to be taken, held by %q", holder)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	e := newLeaderEnv(t, "leader-release", map[string]string{
+		LeaderLabel:        "me",
+		LeaderRenewedLabel: renewedAt(testStart),
+	})
+
+	if err := e.a.releaseLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if holder, renewed := e.lease(); holder != "" || renewed != "" {
+		t.Errorf("expected the lease to be released, got %q at %q", holder, renewed)
+	}
+}
+
+func TestReleaseLeaseHeldByOther(t *testing.T) {
+	e := newLeaderEnv(t, "leader-release-other", map[string]string{
+		LeaderLabel:        "other",
+		LeaderRenewedLabel: renewedAt(testStart),
+	})
+
+	if err := e.a.releaseLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := e.lease(); holder != "other" {
+		t.Errorf("expected the lease of another instance to be kept, held by %q", holder)
+	}
+}
+
+func TestLeaderElectionStepsDownBeforeExpiry(t *testing.T) {
+	e := newLeaderEnv(t, "leader-step-down", nil)
+	o := &failingOrchestrator{FakeOrchestrator: e.orchestrator}
+	e.a.DockerClient = o
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.a.runLeaderElection(ctx, make(chan error, 1))
+	waitFor(t, "leadership", e.monitoring)
+
+	// Renewals fail from now on; the lease expires at +15s
+	o.setFailing(true)
+	e.clock.Advance(5 * time.Second)
+	waitFor(t, "first renewal", func() bool { return o.getFailures() == 1 })
+	if !e.monitoring() {
+		t.Fatal("expected to keep leading after a single failed renewal")
+	}
+
+	// Step down at +10s, a third of the lease duration before the lease
+	// expires and another instance can take over
+	e.clock.Advance(5 * time.Second)
+	waitFor(t, "step down", func() bool { return !e.monitoring() })
+
+	// Leading again once the lease can be renewed
+	o.setFailing(false)
+	e.clock.Advance(5 * time.Second)
+	waitFor(t, "leadership", e.monitoring)
+}
+
+func TestLeaderElectionLosesLease(t *testing.T) {
+	e := newLeaderEnv(t, "leader-lost", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.a.runLeaderElection(ctx, make(chan error, 1))
+	waitFor(t, "leadership", e.monitoring)
+
+	// Another instance took over, e.g. after this one was paused
+	leader, _, _ := e.orchestrator.ServiceInspectWithRaw(context.Background(), e.a.LeaderService)
+	e.orchestrator.Lock()
+	s := e.orchestrator.Services[leader.ID]
+	s.Spec.Labels[LeaderLabel] = "other"
+	s.Spec.Labels[LeaderRenewedLabel] = renewedAt(testStart.Add(5 * time.Second))
+	e.orchestrator.Unlock()
+
+	e.clock.Advance(5 * time.Second)
+	waitFor(t, "step down", func() bool { return !e.monitoring() })
+}
+
+func TestLeaderElectionReleasesLeaseOnShutdown(t *testing.T) {
+	e := newLeaderEnv(t, "leader-shutdown", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		e.a.runLeaderElection(ctx, make(chan error, 1))
+		close(stopped)
+	}()
+	waitFor(t, "leadership", e.monitoring)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected leader election to stop")
+	}
+	if e.monitoring() {
+		t.Error("expected all monitors to be stopped")
+	}
+	if holder, _ := e.lease(); holder != "" {
+		t.Errorf("expected the lease to be released, held by %q", holder)
+	}
+}
@@ -0,0 +1,216 @@
+package auklet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/swarm"
+	"math"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultMetricName is the name of the metric configured with the top level
+// auklet.query label
+const DefaultMetricName = "default"
+
+// metricLabelPrefix is the prefix of labels that configure named metrics,
+// e.g. auklet.metric.cpu.query
+const metricLabelPrefix = "auklet.metric."
+
+// StackNamespaceLabel is the label Docker sets on services deployed as part
+// of a stack
+const StackNamespaceLabel = "com.docker.stack.namespace"
+
+// Metric is a single Prometheus query a Service is scaled on, together with
+// the thresholds its value is tested against.
+type Metric struct {
+	Name          string  `json:"name"`
+	Query         string  `json:"query"`
+	UpThreshold   float64 `json:"up_threshold"`
+	DownThreshold float64 `json:"down_threshold"`
+	TargetValue   float64 `json:"target_value,omitempty"`
+	Aggregation   string  `json:"query_aggregation"`
+	QueryEmpty    string  `json:"query_empty"`
+	Value         float64 `json:"value"`
+	query         *template.Template
+}
+
+// QueryContext holds the variables that can be used in query templates, e.g.
+// `sum(rate(http_requests_total{service="{{.ServiceName}}"}[1m]))`
+type QueryContext struct {
+	ServiceName    string
+	ServiceID      string
+	StackNamespace string
+	Replicas       int
+}
+
+// getServiceMetrics takes the service labels and returns all metrics
+// configured for the service, sorted by name. The legacy auklet.query label
+// results in a metric named "default"; every auklet.metric.<name>.query label
+// results in an additional metric.
+func getServiceMetrics(s *swarm.Service, mode string, tolerance float64) ([]*Metric, error) {
+	var metrics []*Metric
+
+	if _, isSet := s.Spec.Labels["auklet.query"]; isSet {
+		m, err := getMetric(s, DefaultMetricName, "auklet.", mode, tolerance)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+
+	names := make(map[string]bool)
+	for label := range s.Spec.Labels {
+		if !strings.HasPrefix(label, metricLabelPrefix) {
+			continue
+		}
+		i := strings.LastIndex(label, ".")
+		if i <= len(metricLabelPrefix) {
+			return nil, fmt.Errorf("invalid metric label %s", label)
+		}
+		name := label[len(metricLabelPrefix):i]
+		switch label[i+1:] {
+		case "query", "up_threshold", "down_threshold", "target_value", "query_aggregation", "query_empty":
+		default:
+			return nil, fmt.Errorf("invalid metric label %s", label)
+		}
+		names[name] = true
+	}
+
+	for name := range names {
+		if name == DefaultMetricName && len(metrics) > 0 {
+			return nil, fmt.Errorf("metric %q is already configured by auklet.query", name)
+		}
+		m, err := getMetric(s, name, metricLabelPrefix+name+".", mode, tolerance)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+
+	if len(metrics) == 0 {
+		return nil, errors.New("auklet.query or at least one auklet.metric.<name>.query must be set")
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics, nil
+}
+
+// getMetric reads the configuration of a single metric from the labels
+// starting with prefix.
+func getMetric(s *swarm.Service, name string, prefix string, mode string, tolerance float64) (*Metric, error) {
+	var err error
+	m := Metric{Name: name}
+
+	if v, isSet := s.Spec.Labels[prefix+"query"]; isSet {
+		m.Query = v
+	} else {
+		return nil, fmt.Errorf("%squery must be set", prefix)
+	}
+
+	m.query, err = template.New(name).Parse(m.Query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template in %squery: %v", prefix, err)
+	}
+	// Catch references to unknown variables before the first query
+	if _, err := m.render(queryContext(s, 0)); err != nil {
+		return nil, fmt.Errorf("invalid template in %squery: %v", prefix, err)
+	}
+
+	// Named metrics fall back to the service wide auklet.query_* labels
+	m.Aggregation = metricLabel(s, prefix, "query_aggregation", AggregationFirst)
+	switch m.Aggregation {
+	case AggregationFirst, AggregationSum, AggregationAvg, AggregationMax, AggregationMin:
+	default:
+		return nil, fmt.Errorf("invalid value for %squery_aggregation: %q", prefix, m.Aggregation)
+	}
+
+	m.QueryEmpty = metricLabel(s, prefix, "query_empty", QueryEmptyError)
+	switch m.QueryEmpty {
+	case QueryEmptyError, QueryEmptyZero, QueryEmptyHold:
+	default:
+		return nil, fmt.Errorf("invalid value for %squery_empty: %q", prefix, m.QueryEmpty)
+	}
+
+	switch mode {
+	case ModeTarget:
+		m.TargetValue, err = getServiceLabelFloatVal(s, prefix+"target_value")
+		if err != nil {
+			return nil, err
+		}
+		if m.TargetValue <= 0 {
+			return nil, fmt.Errorf("%starget_value must be greater than 0", prefix)
+		}
+
+		// The tolerance band around the target acts as the thresholds, so
+		// the state machine can be shared with step scaling.
+		m.UpThreshold = m.TargetValue * (1 + tolerance)
+		m.DownThreshold = m.TargetValue * (1 - tolerance)
+
+	default:
+		m.UpThreshold, err = getServiceLabelFloatVal(s, prefix+"up_threshold")
+		if err != nil {
+			return nil, err
+		}
+
+		m.DownThreshold, err = getServiceLabelFloatVal(s, prefix+"down_threshold")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &m, nil
+}
+
+// metricLabel returns the value of the metric label with the given prefix and
+// option, or of the service wide auklet.<option> label, or defVal
+func metricLabel(s *swarm.Service, prefix string, option string, defVal string) string {
+	if v, isSet := s.Spec.Labels[prefix+option]; isSet {
+		return v
+	}
+	if v, isSet := s.Spec.Labels["auklet."+option]; isSet {
+		return v
+	}
+	return defVal
+}
+
+// queryContext returns the query template variables of a service
+func queryContext(s *swarm.Service, replicas int) QueryContext {
+	return QueryContext{
+		ServiceName:    s.Spec.Name,
+		ServiceID:      s.ID,
+		StackNamespace: s.Spec.Labels[StackNamespaceLabel],
+		Replicas:       replicas,
+	}
+}
+
+// render executes the query template of the metric
+func (m *Metric) render(ctx QueryContext) (string, error) {
+	var b strings.Builder
+	if err := m.query.Execute(&b, ctx); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// over returns true when the last value of the metric is over its threshold
+func (m *Metric) over() bool {
+	return m.Value > m.UpThreshold
+}
+
+// under returns true when the last value of the metric is under its threshold
+func (m *Metric) under() bool {
+	return m.Value < m.DownThreshold
+}
+
+// targetReplicas computes the number of replicas needed to bring the last
+// value of the metric back to its TargetValue, assuming the metric scales
+// linearly with the number of replicas.
+func (m *Metric) targetReplicas(current int) int {
+	if current < 1 {
+		// A service without replicas can't be scaled proportionally
+		current = 1
+	}
+	return int(math.Ceil(float64(current) * m.Value / m.TargetValue))
+}
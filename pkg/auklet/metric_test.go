@@ -0,0 +1,112 @@
+package auklet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryContext(t *testing.T) {
+	e := newTestEnv(t, "metric-context", 3, map[string]string{StackNamespaceLabel: "shop"})
+	e.svc.CurrentReplicas = 3
+
+	ctx := e.svc.queryContext()
+	expected := QueryContext{
+		ServiceName:    "metric-context",
+		ServiceID:      e.serviceID,
+		StackNamespace: "shop",
+		Replicas:       3,
+	}
+	if ctx != expected {
+		t.Errorf("expected %+v, got %+v", expected, ctx)
+	}
+
+	// Services deployed without a stack have no namespace
+	e = newTestEnv(t, "metric-context-no-stack", 3, nil)
+	if ns := e.svc.queryContext().StackNamespace; ns != "" {
+		t.Errorf("expected no stack namespace, got %q", ns)
+	}
+}
+
+func TestRender(t *testing.T) {
+	ctx := QueryContext{ServiceName: "web", ServiceID: "abc", StackNamespace: "shop", Replicas: 4}
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{`sum(rate(http_requests_total[1m]))`, `sum(rate(http_requests_total[1m]))`},
+		{`up{service="{{.ServiceName}}",id="{{.ServiceID}}"}`, `up{service="web",id="abc"}`},
+		{`queue_length{stack="{{.StackNamespace}}"} / {{.Replicas}}`, `queue_length{stack="shop"} / 4`},
+		{`{{if gt .Replicas 2}}many{{else}}few{{end}}`, `many`},
+	} {
+		e := newTestEnv(t, "metric-render", 1, map[string]string{"auklet.query": tc.query})
+		query, err := e.svc.Metrics[0].render(ctx)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		if query != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.query, tc.expected, query)
+		}
+	}
+}
+
+func TestPollRendersQuery(t *testing.T) {
+	e := newTestEnv(t, "metric-poll-render", 2, map[string]string{
+		"auklet.query":      `load{stack="{{.StackNamespace}}",service="{{.ServiceName}}"} / {{.Replicas}}`,
+		StackNamespaceLabel: "shop",
+	})
+	e.metrics.Set(`load{stack="shop",service="metric-poll-render"} / 2`, 90)
+	e.metrics.Set(`load{stack="shop",service="metric-poll-render"} / 3`, 50)
+
+	e.poll()
+	e.expectReplicas(3)
+
+	// The query is rendered with the current number of replicas on every poll
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	if e.svc.Failures != 0 {
+		t.Errorf("expected no query failures, got %d", e.svc.Failures)
+	}
+}
+
+func TestGetServiceRejectsInvalidTemplates(t *testing.T) {
+	e := newTestEnv(t, "metric-invalid-template", 1, nil)
+
+	for _, tc := range []struct {
+		labels map[string]string
+		err    string
+	}{
+		{map[string]string{"auklet.query": `up{service="{{.ServiceName}"}`}, "invalid template in auklet.query: "},
+		{map[string]string{"auklet.query": `{{unknown .ServiceName}}`}, "invalid template in auklet.query: "},
+		{map[string]string{"auklet.query": `up{service="{{.Service}}"}`}, "invalid template in auklet.query: "},
+		{map[string]string{
+			"auklet.metric.cpu.query":          `{{.Stack}}`,
+			"auklet.metric.cpu.up_threshold":   "80",
+			"auklet.metric.cpu.down_threshold": "20",
+		}, "invalid template in auklet.metric.cpu.query: "},
+	} {
+		s := e.orchestrator.AddService("metric-invalid-template", 1, testLabels(tc.labels))
+		_, err := getService(e.a, &s)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%v: expected error %q, got %v", tc.labels, tc.err, err)
+		}
+	}
+}
+
+func TestPollQueryRenderError(t *testing.T) {
+	// Errors that depend on the values are only found when polling
+	e := newTestEnv(t, "metric-render-error", 2, map[string]string{
+		"auklet.query": `{{if lt .Replicas 2}}load{{else}}{{index .ServiceName 100}}{{end}}`,
+	})
+
+	e.poll()
+	if e.svc.Failures != 1 {
+		t.Fatalf("expected the poll to fail, got %d failures", e.svc.Failures)
+	}
+	if n := e.metrics.Queries; n != 0 {
+		t.Errorf("expected no queries, got %d", n)
+	}
+	e.expectReplicas(2)
+}
@@ -3,42 +3,82 @@ package auklet
 import (
 	"errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // Auklet specific metrics that are exposed on /metrics
 const (
-	MetricServicesMonitored       = "services_monitored"
-	MetricPrometheusQueriesTotal  = "prometheus_queries_total"
-	MetricServiceScaleEventsTotal = "scale_events_total"
-	MetricScaleUpEventsCount      = "scale_up_events_count"
-	MetricScaleDownEventsCount    = "scale_down_events_count"
+	MetricServicesMonitored          = "services_monitored"
+	MetricPrometheusQueriesTotal     = "prometheus_queries_total"
+	MetricPrometheusQueryErrorsTotal = "prometheus_query_errors_total"
+	MetricServiceScaleEventsTotal    = "scale_events_total"
+	MetricLeader                     = "leader"
+	MetricScaleUpEventsCount         = "scale_up_events_count"
+	MetricScaleDownEventsCount       = "scale_down_events_count"
+	MetricDryRunScaleEventsCount     = "dry_run_scale_events_count"
+	MetricQueryFailures              = "query_failures"
+	MetricPaused                     = "paused"
+	MetricPinned                     = "pinned"
+	MetricCooldown                   = "cooldown"
+	MetricConfigValid                = "config_valid"
+	MetricValue                      = "metric_value"
+	MetricUpThreshold                = "up_threshold"
+	MetricDownThreshold              = "down_threshold"
+	MetricCurrentReplicas            = "current_replicas"
+	MetricDesiredReplicas            = "desired_replicas"
+	MetricMinReplicas                = "min_replicas"
+	MetricMaxReplicas                = "max_replicas"
+	MetricState                      = "state"
+	MetricGraceRemaining             = "grace_remaining_seconds"
+	MetricQueryDuration              = "query_duration_seconds"
+	MetricNotificationsTotal         = "notifications_total"
+	MetricNotificationErrorsTotal    = "notification_errors_total"
 
 	MetricTypeGauge = iota
 	MetricTypeCounter
+	MetricTypeHistogram
 )
 
-// registerMetrics uses promauto to register Auklet metrics in the prometheus
-// metrics handler, and returns a map of all registered metrics.
+// registerMetrics registers Auklet metrics in the prometheus metrics handler,
+// and returns a map of all registered metrics.
 func registerGlobalMetrics() map[string]prometheus.Metric {
 
 	metrics := make(map[string]prometheus.Metric)
 
-	metrics[MetricServicesMonitored] = promauto.NewGauge(prometheus.GaugeOpts{
+	metrics[MetricServicesMonitored] = register(prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "auklet",
 		Name:      MetricServicesMonitored,
 		Help:      "Number of services currently monitored by Auklet",
-	})
-	metrics[MetricPrometheusQueriesTotal] = promauto.NewCounter(prometheus.CounterOpts{
+	}))
+	metrics[MetricPrometheusQueriesTotal] = register(prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "auklet",
 		Name:      MetricPrometheusQueriesTotal,
 		Help:      "Total number of Prometheus queries executed",
-	})
-	metrics[MetricServiceScaleEventsTotal] = promauto.NewCounter(prometheus.CounterOpts{
+	}))
+	metrics[MetricPrometheusQueryErrorsTotal] = register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "auklet",
+		Name:      MetricPrometheusQueryErrorsTotal,
+		Help:      "Total number of failed Prometheus queries",
+	}))
+	metrics[MetricServiceScaleEventsTotal] = register(prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "auklet",
 		Name:      MetricServiceScaleEventsTotal,
 		Help:      "Total number of Prometheus queries executed",
-	})
+	}))
+	metrics[MetricLeader] = register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "auklet",
+		Name:      MetricLeader,
+		Help:      "Whether this Auklet instance is the leader (1) or not (0)",
+	}))
+	metrics[MetricNotificationsTotal] = register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "auklet",
+		Name:      MetricNotificationsTotal,
+		Help:      "Total number of webhook notifications sent",
+	}))
+	metrics[MetricNotificationErrorsTotal] = register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "auklet",
+		Name:      MetricNotificationErrorsTotal,
+		Help:      "Total number of webhook notifications that failed after all retries",
+	}))
 
 	return metrics
 }
@@ -53,48 +93,213 @@ func (a *Auklet) createServiceMetrics(serviceID string, serviceName string) erro
 		"Number of times the service was scaled down", MetricTypeCounter); err != nil {
 		return err
 	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricDryRunScaleEventsCount,
+		"Number of times the service would have been scaled in dry-run mode", MetricTypeCounter); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricQueryFailures,
+		"Number of consecutive failed Prometheus queries for the service", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricCooldown,
+		"Whether the service is in a cooldown period after scaling (1) or not (0)", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricConfigValid,
+		"Whether the autoscaling configuration of the service is valid (1) or not (0)", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricPaused,
+		"Whether autoscaling of the service is paused (1) or not (0)", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricPinned,
+		"Whether the service is pinned to a fixed number of replicas (1) or not (0)", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricValue,
+		"Last value returned by the query of the metric", MetricTypeGauge, "metric"); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricUpThreshold,
+		"Upper threshold of the metric", MetricTypeGauge, "metric"); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricDownThreshold,
+		"Lower threshold of the metric", MetricTypeGauge, "metric"); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricCurrentReplicas,
+		"Current number of replicas of the service", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricDesiredReplicas,
+		"Number of replicas the last decision wants the service to have", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricMinReplicas,
+		"Minimum number of replicas, including active schedules", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricMaxReplicas,
+		"Maximum number of replicas, including active schedules", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricState,
+		"Whether the service is in the state (1) or not (0)", MetricTypeGauge, "state"); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricGraceRemaining,
+		"Seconds remaining of the running grace period", MetricTypeGauge); err != nil {
+		return err
+	}
+	if err := a.registerServiceMetric(serviceID, serviceName, MetricQueryDuration,
+		"Duration of the Prometheus queries of the metric", MetricTypeHistogram, "metric"); err != nil {
+		return err
+	}
 	return nil
 }
 
 // registerServiceMetric registers a new service specific metric if it doesn't
-// already exist.
-func (a *Auklet) registerServiceMetric(serviceID string, serviceName string, metricName string, desc string, metricType int) error {
+// already exist. When label names are given, a gauge or histogram vector
+// with these labels is registered.
+func (a *Auklet) registerServiceMetric(serviceID string, serviceName string, metricName string, desc string, metricType int, labels ...string) error {
+	a.Lock()
+	defer a.Unlock()
+
 	// First initialize the metrics map if it's a new service
 	if _, exists := a.serviceMetrics[serviceID]; !exists {
-		a.serviceMetrics[serviceID] = make(map[string]prometheus.Metric)
-	}
-
-	// If the metric doesn't exist, add it to the service metrics map
-	if _, exists := a.serviceMetrics[serviceID][metricName]; !exists {
-		a.Lock()
-		defer a.Unlock()
-
-		switch metricType {
-		case MetricTypeCounter:
-			a.serviceMetrics[serviceID][metricName] = promauto.NewCounter(prometheus.CounterOpts{
-				Namespace: "auklet",
-				Subsystem: "service",
-				Name:      metricName,
-				Help:      desc,
-				ConstLabels: prometheus.Labels{
-					"service":    serviceName,
-					"service_id": serviceID,
-				},
-			})
-		case MetricTypeGauge:
-			a.serviceMetrics[serviceID][metricName] = promauto.NewGauge(prometheus.GaugeOpts{
-				Namespace: "auklet",
-				Subsystem: "service",
-				Name:      metricName,
-				Help:      desc,
-				ConstLabels: prometheus.Labels{
-					"service":    serviceName,
-					"service_id": serviceID,
-				},
-			})
-		default:
-			return errors.New("unsupported or unknown metric type")
+		a.serviceMetrics[serviceID] = make(map[string]prometheus.Collector)
+	}
+
+	// If the metric already exists, there's nothing to do
+	if _, exists := a.serviceMetrics[serviceID][metricName]; exists {
+		return nil
+	}
+
+	constLabels := prometheus.Labels{
+		"service":    serviceName,
+		"service_id": serviceID,
+	}
+
+	var c prometheus.Collector
+	switch metricType {
+	case MetricTypeCounter:
+		if len(labels) > 0 {
+			return errors.New("counter vectors are not supported")
+		}
+		c = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "auklet",
+			Subsystem:   "service",
+			Name:        metricName,
+			Help:        desc,
+			ConstLabels: constLabels,
+		})
+	case MetricTypeGauge:
+		opts := prometheus.GaugeOpts{
+			Namespace:   "auklet",
+			Subsystem:   "service",
+			Name:        metricName,
+			Help:        desc,
+			ConstLabels: constLabels,
 		}
+		if len(labels) > 0 {
+			c = prometheus.NewGaugeVec(opts, labels)
+		} else {
+			c = prometheus.NewGauge(opts)
+		}
+	case MetricTypeHistogram:
+		opts := prometheus.HistogramOpts{
+			Namespace:   "auklet",
+			Subsystem:   "service",
+			Name:        metricName,
+			Help:        desc,
+			ConstLabels: constLabels,
+			Buckets:     prometheus.DefBuckets,
+		}
+		if len(labels) > 0 {
+			c = prometheus.NewHistogramVec(opts, labels)
+		} else {
+			c = prometheus.NewHistogram(opts)
+		}
+	default:
+		return errors.New("unsupported or unknown metric type")
 	}
+
+	a.serviceMetrics[serviceID][metricName] = registerCollector(c)
 	return nil
 }
+
+// setServiceMetric sets the value of a service specific gauge, if it exists.
+// For gauge vectors the values of its labels must be given.
+func (a *Auklet) setServiceMetric(serviceID string, metricName string, value float64, labelValues ...string) {
+	a.Lock()
+	defer a.Unlock()
+	switch m := a.serviceMetrics[serviceID][metricName].(type) {
+	case prometheus.Gauge:
+		m.Set(value)
+	case *prometheus.GaugeVec:
+		m.WithLabelValues(labelValues...).Set(value)
+	}
+}
+
+// incServiceMetric increments a service specific counter, if it exists
+func (a *Auklet) incServiceMetric(serviceID string, metricName string) {
+	a.Lock()
+	defer a.Unlock()
+	if m, ok := a.serviceMetrics[serviceID][metricName].(prometheus.Counter); ok {
+		m.Inc()
+	}
+}
+
+// observeServiceMetric adds an observation to a service specific histogram,
+// if it exists. For histogram vectors the values of its labels must be given.
+func (a *Auklet) observeServiceMetric(serviceID string, metricName string, value float64, labelValues ...string) {
+	a.Lock()
+	defer a.Unlock()
+	switch m := a.serviceMetrics[serviceID][metricName].(type) {
+	case prometheus.Histogram:
+		m.Observe(value)
+	case *prometheus.HistogramVec:
+		m.WithLabelValues(labelValues...).Observe(value)
+	}
+}
+
+// resetServiceMetric deletes all label values of a service specific gauge
+// vector, e.g. after the metrics of the service were reconfigured
+func (a *Auklet) resetServiceMetric(serviceID string, metricName string) {
+	a.Lock()
+	defer a.Unlock()
+	if m, ok := a.serviceMetrics[serviceID][metricName].(*prometheus.GaugeVec); ok {
+		m.Reset()
+	}
+}
+
+// deleteServiceMetrics unregisters all service specific metrics of a service
+// that is no longer monitored, so its last values aren't exported anymore.
+// Must be called with a locked.
+func (a *Auklet) deleteServiceMetrics(serviceID string) {
+	for _, c := range a.serviceMetrics[serviceID] {
+		prometheus.Unregister(c)
+	}
+	delete(a.serviceMetrics, serviceID)
+}
+
+// register registers the metric in the prometheus metrics handler. When an
+// identical metric was already registered, for instance by another Auklet
+// instance within the same process, the existing metric is returned instead.
+func register(m prometheus.Metric) prometheus.Metric {
+	return registerCollector(m.(prometheus.Collector)).(prometheus.Metric)
+}
+
+// registerCollector registers the collector in the prometheus metrics
+// handler, or returns the identical collector that was already registered.
+func registerCollector(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package auklet
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exportedSeries returns the number of series exported for the service. The
+// fake orchestrators of all tests hand out the same IDs, so series are
+// matched by the unique service names of the tests.
+func exportedSeries(t *testing.T, serviceName string) int {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "service" && l.GetValue() == serviceName {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+func TestDeleteMonitorUnregistersMetrics(t *testing.T) {
+	e := newTestEnv(t, "metrics-delete", 2, nil)
+	e.metrics.Set("load", 50)
+	e.poll()
+	if exportedSeries(t, e.svc.ServiceName) == 0 {
+		t.Fatal("expected the metrics of the service to be exported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+	e.a.deleteMonitor(e.serviceID)
+
+	if n := exportedSeries(t, e.svc.ServiceName); n != 0 {
+		t.Errorf("expected no series after deleting the monitor, got %d", n)
+	}
+	e.a.Lock()
+	_, found := e.a.serviceMetrics[e.serviceID]
+	e.a.Unlock()
+	if found {
+		t.Error("expected the service metrics to be forgotten")
+	}
+
+	// Polls of a monitor that is still stopping don't fail
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.expectReplicas(3)
+	if n := exportedSeries(t, e.svc.ServiceName); n != 0 {
+		t.Errorf("expected no series after a late poll, got %d", n)
+	}
+
+	// Monitoring the service again exports its metrics again
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+	if exportedSeries(t, e.svc.ServiceName) == 0 {
+		t.Error("expected the metrics of the service to be exported again")
+	}
+	e.a.deleteMonitor(e.serviceID)
+}
+
+func TestStepDownUnregistersMetrics(t *testing.T) {
+	e := newTestEnv(t, "metrics-step-down", 2, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+
+	e.a.stepDown(cancel)
+	if n := exportedSeries(t, e.svc.ServiceName); n != 0 {
+		t.Errorf("expected no series after stepping down, got %d", n)
+	}
+}
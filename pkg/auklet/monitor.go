@@ -2,115 +2,429 @@ package auklet
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// monitorService takes a Service, and starts monitoring it
-func (a *Auklet) monitorService(ctx context.Context, s swarm.Service) {
-	monitorLogger := log.WithFields(log.Fields{
+// monitorService takes a Service, and starts monitoring it. Updated versions
+// of the service are received on the updates channel. A service with an
+// invalid configuration isn't polled until an update fixes the configuration.
+func (a *Auklet) monitorService(ctx context.Context, s swarm.Service, updates chan swarm.Service) {
+	fields := log.Fields{
 		"service_id":   s.ID,
 		"service_name": s.Spec.Name,
-		"replicas":     *s.Spec.Mode.Replicated.Replicas,
-	})
+	}
+	if replicas, ok := serviceReplicas(&s); ok {
+		fields["replicas"] = replicas
+	}
+	monitorLogger := log.WithFields(fields)
 	monitorLogger.Debug("Monitor started")
+	defer a.monitorStopped(s.ID, updates)
 
 	svc, err := getService(a, &s)
 	if err != nil {
-		monitorLogger.Error(err)
-		// Defunct poller needs to cancel itself to prevent ctx leaks
-		a.deleteMonitor(s.ID)
+		monitorLogger.WithError(err).Error("Invalid autoscaling configuration")
+		svc = getInvalidService(a, &s, err)
+	}
+	a.registerService(svc)
+	defer func() { a.unregisterService(svc) }()
+
+	var timer Ticker
+	var tick <-chan time.Time
+	resetTimer := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, tick = nil, nil
+		}
+		if svc.ConfigError == "" {
+			timer = a.Clock.NewTicker(svc.PollInterval)
+			tick = timer.C()
+		}
+	}
+	resetTimer()
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-tick:
+			a.pollService(ctx, svc, monitorLogger)
+
+		case s := <-updates:
+			newSvc := a.reconfigureService(svc, &s)
+			if newSvc.ConfigError != "" && newSvc != svc {
+				monitorLogger.WithField("error", newSvc.ConfigError).Error("Invalid autoscaling configuration")
+			}
+			reset := newSvc.PollInterval != svc.PollInterval || newSvc.ConfigError != svc.ConfigError
+			svc = newSvc
+			if reset {
+				resetTimer()
+			}
+
+		case <-ctx.Done():
+			// cancel() was called
+			monitorLogger.Debug("Monitor stopped")
+			return
+		}
+	}
+}
+
+// pollService queries the metrics of the service and the service itself, and
+// emits the resulting event to the service's state machine.
+func (a *Auklet) pollService(ctx context.Context, svc *Service, monitorLogger *log.Entry) {
+	svc.Lock()
+	defer svc.Unlock()
+
+	fromState := svc.state
+	svc.outcome = ""
+	defer func() {
+		if svc.outcome != OutcomeFailed {
+			svc.scaleFailing = false
+		}
+		svc.recordDecision(fromState)
+		svc.setMetrics()
+	}()
+
+	control := a.getControl(svc.ServiceID)
+	if control.Pinned {
+		a.pollPinnedService(ctx, svc, control.Replicas, monitorLogger)
+		return
+	}
+	if control.Paused {
+		monitorLogger.Debug("Autoscaling paused")
+		svc.stable()
+		return
+	}
+
+	a.refreshReplicas(ctx, svc, monitorLogger)
+
+	// The bounds, including scheduled ones, don't depend on the metrics; they
+	// are enforced even while the queries fail or hold.
+	svc.applySchedules(a.Clock.Now())
+	monitorLogger.Debugf("Current state: %s", svc.state)
+
+	if svc.CurrentReplicas < svc.MinReplicas {
+		monitorLogger.Debug("Emitting 'scale' event")
+		svc.Driver = ""
+		svc.scale(ctx, svc.MinReplicas)
+		return
+	} else if svc.CurrentReplicas > svc.MaxReplicas {
+		monitorLogger.Debug("Emitting 'scale' event")
+		svc.Driver = ""
+		svc.scale(ctx, svc.MaxReplicas)
+		return
+	}
+
+	monitorLogger.Debug("Poll Prometheus")
+	err := a.queryMetrics(ctx, svc)
+	if err == errQueryHold {
+		// Neither a failure nor a basis for a decision
+		return
+	}
+	if err != nil {
+		// Never base a decision on a failed query; a Prometheus
+		// outage would otherwise scale every service down.
+		monitorLogger.WithError(err).Error("Error while executing Prometheus query")
+		svc.queryFailed(ctx, err)
+		return
+	}
+	svc.querySucceeded()
+	svc.LastPoll = a.Clock.Now()
+
+	svc.evaluate(ctx)
+}
+
+// pollPinnedService keeps a pinned service at its fixed number of replicas,
+// without querying its metrics.
+func (a *Auklet) pollPinnedService(ctx context.Context, svc *Service, replicas int, monitorLogger *log.Entry) {
+	monitorLogger.WithField("pinned_replicas", replicas).Debug("Service pinned")
+	svc.stable()
+
+	if !a.refreshReplicas(ctx, svc, monitorLogger) {
+		return
+	}
+	if svc.CurrentReplicas != replicas {
+		monitorLogger.Debug("Emitting 'scale' event")
+		svc.Driver = ""
+		svc.scale(ctx, replicas)
+	}
+}
+
+// refreshReplicas reads the current number of replicas of the service from
+// Docker. It returns false when the service couldn't be queried, or isn't in
+// replicated mode, leaving the last known number of replicas.
+func (a *Auklet) refreshReplicas(ctx context.Context, svc *Service, monitorLogger *log.Entry) bool {
+	s, err := a.getServiceByID(ctx, svc.ServiceID)
+	if err != nil {
+		monitorLogger.WithError(err).Error("Error while querying service from Docker")
+		return false
+	}
+	replicas, ok := serviceReplicas(s)
+	if !ok {
+		monitorLogger.Warn("Service is not in replicated mode; not scaling")
+		return false
+	}
+	svc.CurrentReplicas = replicas
+	svc.DesiredReplicas = svc.CurrentReplicas
+	return true
+}
+
+// reconfigureService applies an updated version of the service to the
+// monitor. Only when the autoscaling configuration (the auklet.* labels)
+// changed a new Service is returned and registered, which resets its state;
+// other updates, like changes of the number of replicas by Auklet itself,
+// leave the Service untouched. When the new configuration is invalid, the
+// returned Service holds the reason in ConfigError.
+func (a *Auklet) reconfigureService(svc *Service, s *swarm.Service) *Service {
+	if reflect.DeepEqual(autoscaleLabels(s.Spec.Labels), svc.labels) {
+		log.WithField("service_id", s.ID).Debug("Autoscaling configuration unchanged")
+		return svc
+	}
+
+	newSvc, err := getService(a, s)
+	if err != nil {
+		newSvc = getInvalidService(a, s, err)
 	} else {
-		timer := time.NewTicker(svc.PollInterval)
-
-		for {
-			select {
-			case <-timer.C:
-				monitorLogger.Debug("Poll Prometheus")
-				m, err := a.getMetric(ctx, svc.Query)
-				if err != nil {
-					monitorLogger.WithError(err).Error("Error while executing Prometheus query")
-				}
-				monitorLogger.Debugf("Query returned: %f", m)
-
-				s, err := a.getServiceByID(ctx, svc.ServiceID)
-				if err != nil {
-					monitorLogger.WithError(err).Error("Error while querying service from Docker")
-				}
-
-				if s != nil {
-					svc.CurrentReplicas = int(*s.Spec.Mode.Replicated.Replicas)
-				}
-
-				monitorLogger.Debugf("Current state: %s", svc.state)
-
-				if svc.CurrentReplicas < svc.MinReplicas {
-					monitorLogger.Debug("Emitting 'scale' event")
-					svc.scale(svc.MinReplicas)
-				} else if svc.CurrentReplicas > svc.MaxReplicas {
-					monitorLogger.Debug("Emitting 'scale' event")
-					svc.scale(svc.MaxReplicas)
-				} else if m < svc.DownThreshold {
-					monitorLogger.Debug("Emitting 'under_threshold' event")
-					svc.underThreshold()
-				} else if m > svc.UpThreshold {
-					monitorLogger.Debug("Emitting 'over_threshold' event")
-					svc.overThreshold()
-				} else {
-					monitorLogger.Debug("Emitting 'stable' event")
-					svc.stable()
-				}
-
-			case <-ctx.Done():
-				// cancel() was called
-				monitorLogger.Debug("Monitor stopped")
-				return
+		log.WithField("service_id", s.ID).Info("Autoscaling configuration changed")
+	}
+
+	// Keep what is known about the service, only the state is reset
+	svc.Lock()
+	newSvc.CurrentReplicas = svc.CurrentReplicas
+	newSvc.DesiredReplicas = svc.DesiredReplicas
+	newSvc.LastPoll = svc.LastPoll
+	newSvc.History = svc.History
+	svc.Unlock()
+
+	a.registerService(newSvc)
+	return newSvc
+}
+
+// errQueryHold is returned by queryMetrics when a query returned no data,
+// and the service should hold without making a decision
+var errQueryHold = errors.New("query returned no data; holding")
+
+// queryMetrics executes the queries of all metrics of the service, and stores
+// the values in the metrics. Query templates are rendered with the current
+// state of the service. An error is returned as soon as a query fails.
+func (a *Auklet) queryMetrics(ctx context.Context, svc *Service) error {
+	for _, m := range svc.Metrics {
+		query, err := m.render(svc.queryContext())
+		if err != nil {
+			return fmt.Errorf("metric %s: could not render query: %v", m.Name, err)
+		}
+		start := time.Now()
+		v, err := a.getMetric(ctx, query, m.Aggregation)
+		a.observeServiceMetric(svc.ServiceID, MetricQueryDuration, time.Since(start).Seconds(), m.Name)
+		if err == errEmptyResult {
+			switch m.QueryEmpty {
+			case QueryEmptyZero:
+				v, err = 0, nil
+			case QueryEmptyHold:
+				log.WithFields(log.Fields{
+					"service_id": svc.ServiceID,
+					"metric":     m.Name,
+				}).Debug("Query returned no data; holding")
+				return errQueryHold
 			}
 		}
+		if err != nil {
+			return fmt.Errorf("metric %s: %v", m.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"service_id": svc.ServiceID,
+			"metric":     m.Name,
+		}).Debugf("Query returned: %f", v)
+		m.Value = v
 	}
-	monitorLogger.Debug("Monitor exited")
+	return nil
 }
 
 // startMonitor launches a new service monitor when the service has a label
 // called `auklet.autoscale` set to true.
 func (a *Auklet) startMonitor(ctx context.Context, s swarm.Service) {
-	if _, found := a.CancelMonitor[s.ID]; !found {
-		if enable, ok := s.Spec.Labels["auklet.autoscale"]; ok {
-			if e, _ := strconv.ParseBool(enable); e {
-				ctx, cancel := context.WithCancel(ctx)
-				a.Lock()
-				a.CancelMonitor[s.ID] = cancel
-				a.metrics[MetricServicesMonitored].(prometheus.Gauge).Inc()
-				a.Unlock()
-				go a.monitorService(ctx, s)
-
-				if err := a.createServiceMetrics(s.ID, s.Spec.Name); err != nil {
-					log.WithError(err).Error("Failed to create service metrics")
-				}
-				return
-			}
-		}
+	if !autoscaleEnabled(&s) {
 		log.WithField("service_id", s.ID).Info("Ignore service; auklet.autoscale not set")
-	} else {
+		return
+	}
+
+	// The metrics are created up front, so a monitor deleted right after it
+	// was started doesn't leave metrics behind
+	if err := a.createServiceMetrics(s.ID, s.Spec.Name); err != nil {
+		log.WithError(err).Error("Failed to create service metrics")
+	}
+
+	a.Lock()
+	if _, found := a.CancelMonitor[s.ID]; found {
+		a.Unlock()
 		log.WithField("service_id", s.ID).Debug("Monitor already present")
+		return
 	}
+	if ctx.Err() != nil {
+		// Stepped down while the event was handled; don't leave a monitor
+		// behind that will never run.
+		a.deleteServiceMetrics(s.ID)
+		a.Unlock()
+		log.WithField("service_id", s.ID).Debug("Not leading; monitor not started")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	updates := make(chan swarm.Service, 1)
+	a.CancelMonitor[s.ID] = cancel
+	a.monitorUpdates[s.ID] = updates
+	a.metrics[MetricServicesMonitored].(prometheus.Gauge).Inc()
+	a.Unlock()
+
+	go a.monitorService(ctx, s, updates)
 }
 
 // deleteMonitor calls cancel on the monitor to stop it, and deletes
 // the cancel() func from Auklet's CancelMonitor map
 func (a *Auklet) deleteMonitor(serviceID string) {
+	a.Lock()
+	defer a.Unlock()
 	if cancel, exists := a.CancelMonitor[serviceID]; exists {
-		a.Lock()
 		cancel()
 		delete(a.CancelMonitor, serviceID)
+		delete(a.monitorUpdates, serviceID)
+		a.deleteServiceMetrics(serviceID)
 		a.metrics[MetricServicesMonitored].(prometheus.Gauge).Dec()
-		a.Unlock()
 	}
 }
 
+// monitorStopped removes the monitor of the service from Auklet when it
+// stopped by itself, e.g. because its context was cancelled, unless the
+// service is monitored by a newer monitor in the meantime. Monitors are
+// identified by their updates channel.
+func (a *Auklet) monitorStopped(serviceID string, updates chan swarm.Service) {
+	a.Lock()
+	defer a.Unlock()
+	if a.monitorUpdates[serviceID] != updates {
+		return
+	}
+	a.CancelMonitor[serviceID]()
+	delete(a.CancelMonitor, serviceID)
+	delete(a.monitorUpdates, serviceID)
+	a.deleteServiceMetrics(serviceID)
+	a.metrics[MetricServicesMonitored].(prometheus.Gauge).Dec()
+}
+
+// registerService makes the service known to Auklet, so its state can be
+// inspected through the API.
+func (a *Auklet) registerService(svc *Service) {
+	a.Lock()
+	a.services[svc.ServiceID] = svc
+	a.Unlock()
+
+	valid := 1.0
+	if svc.ConfigError != "" {
+		valid = 0
+	}
+	a.setServiceMetric(svc.ServiceID, MetricConfigValid, valid)
+
+	// The metrics of the service may have been reconfigured
+	a.resetServiceMetric(svc.ServiceID, MetricValue)
+	a.resetServiceMetric(svc.ServiceID, MetricUpThreshold)
+	a.resetServiceMetric(svc.ServiceID, MetricDownThreshold)
+	svc.Lock()
+	svc.setMetrics()
+	svc.Unlock()
+}
+
+// unregisterService removes the service from Auklet, unless it was already
+// replaced by a new monitor for the same service.
+func (a *Auklet) unregisterService(svc *Service) {
+	a.Lock()
+	defer a.Unlock()
+	if a.services[svc.ServiceID] == svc {
+		delete(a.services, svc.ServiceID)
+	}
+}
+
+// removeMonitor deletes the monitor of a service that was removed from the
+// Swarm, including its manual overrides
+func (a *Auklet) removeMonitor(serviceID string) {
+	a.deleteMonitor(serviceID)
+	a.Lock()
+	delete(a.controls, serviceID)
+	a.Unlock()
+}
+
+// deleteAllMonitors stops all monitors
+func (a *Auklet) deleteAllMonitors() {
+	a.Lock()
+	ids := make([]string, 0, len(a.CancelMonitor))
+	for id := range a.CancelMonitor {
+		ids = append(ids, id)
+	}
+	a.Unlock()
+
+	for _, id := range ids {
+		a.deleteMonitor(id)
+	}
+}
+
+// updateMonitor hands an updated version of the service to its monitor. When
+// autoscaling was enabled or disabled for the service, the monitor is started
+// or deleted instead.
+func (a *Auklet) updateMonitor(ctx context.Context, s swarm.Service) {
+	a.Lock()
+	updates, found := a.monitorUpdates[s.ID]
+	a.Unlock()
+
+	switch {
+	case !found:
+		a.startMonitor(ctx, s)
+
+	case !autoscaleEnabled(&s):
+		log.WithField("service_id", s.ID).Info("Delete monitor; auklet.autoscale not set")
+		a.deleteMonitor(s.ID)
+
+	default:
+		// Only the latest version of the service is relevant; replace any
+		// pending update the monitor didn't pick up yet.
+		select {
+		case <-updates:
+		default:
+		}
+		select {
+		case updates <- s:
+		default:
+		}
+	}
+}
+
+// autoscaleEnabled returns true when the service has a label called
+// `auklet.autoscale` set to true.
+func autoscaleEnabled(s *swarm.Service) bool {
+	e, _ := strconv.ParseBool(s.Spec.Labels["auklet.autoscale"])
+	return e
+}
+
+// autoscaleLabels returns the labels that configure autoscaling of a service.
+// The annotations Auklet writes itself are left out, so scaling a service
+// doesn't reconfigure it.
+func autoscaleLabels(labels map[string]string) map[string]string {
+	l := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, "auklet.") && !annotationLabels[k] {
+			l[k] = v
+		}
+	}
+	return l
+}
+
 // addMonitor queries the service by its ID and starts a monitor for it
 func (a *Auklet) addMonitor(ctx context.Context, serviceID string) {
 	s, err := a.getServiceByID(ctx, serviceID)
@@ -0,0 +1,65 @@
+package auklet
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestStartDeleteMonitorConcurrently(t *testing.T) {
+	e := newTestEnv(t, "monitor-concurrent", 1, nil)
+	s := e.orchestrator.AddService("monitor-concurrent-2", 1, testLabels(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			e.a.addMonitor(ctx, s.ID)
+		}()
+		go func() {
+			defer wg.Done()
+			e.a.deleteAllMonitors()
+		}()
+	}
+	wg.Wait()
+
+	e.a.deleteAllMonitors()
+	e.a.Lock()
+	defer e.a.Unlock()
+	if len(e.a.CancelMonitor) != 0 || len(e.a.monitorUpdates) != 0 {
+		t.Errorf("expected no monitors, got %d", len(e.a.CancelMonitor))
+	}
+}
+
+func TestStartMonitorAfterSteppingDown(t *testing.T) {
+	e := newTestEnv(t, "leader-start-cancelled", 2, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+	if e.monitoring() {
+		t.Error("expected no monitor to be started with a cancelled context")
+	}
+}
+
+func TestMonitorRemovesItselfWhenCancelled(t *testing.T) {
+	e := newTestEnv(t, "leader-monitor-cancelled", 2, nil)
+
+	// The leader context is cancelled without deleting the monitors first,
+	// like when stepping down while an event is handled
+	ctx, cancel := context.WithCancel(context.Background())
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+	cancel()
+	waitFor(t, "monitor removed", func() bool { return !e.monitoring() })
+
+	// Leading again monitors the service again
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	e.a.startMonitor(ctx, *e.orchestrator.Services[e.serviceID])
+	if !e.monitoring() {
+		t.Error("expected the service to be monitored again")
+	}
+}
@@ -0,0 +1,251 @@
+package auklet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Constants representing the events that trigger a webhook notification
+const (
+	// NotifyEventScale is sent whenever a service is scaled, or fails to be
+	// scaled; not for dry-run scale actions
+	NotifyEventScale = "scale"
+	// NotifyEventError is sent when the queries of a service keep failing
+	NotifyEventError = "error"
+)
+
+// Default settings of webhook notifications
+const (
+	DefaultNotifyRetries = 3
+	DefaultNotifyBackoff = time.Second
+	notifyTimeout        = 10 * time.Second
+)
+
+// SignatureHeader is the header holding the HMAC-SHA256 signature of the body
+// of a notification, when a secret is configured
+const SignatureHeader = "X-Auklet-Signature"
+
+// notifyLabelPrefix is the prefix of labels that configure notifications
+const notifyLabelPrefix = "auklet.notify."
+
+// Notify configures the webhook notifications of a service. When no body
+// template is set, the Notification itself is sent as JSON.
+type Notify struct {
+	URL     string        `json:"url,omitempty"`
+	Body    string        `json:"body,omitempty"`
+	Secret  string        `json:"-"`
+	Events  []string      `json:"events"`
+	Retries int           `json:"retries"`
+	Backoff time.Duration `json:"backoff"`
+	body    *template.Template
+}
+
+// Notification is the payload of a webhook, and the data its body template is
+// rendered with
+type Notification struct {
+	Event       string       `json:"event"`
+	Time        time.Time    `json:"time"`
+	ServiceID   string       `json:"service_id"`
+	ServiceName string       `json:"service_name"`
+	From        int          `json:"from"`
+	To          int          `json:"to"`
+	Driver      string       `json:"driver,omitempty"`
+	Outcome     ScaleOutcome `json:"outcome,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// DefaultNotify returns the notification settings used when neither the
+// config file nor the service labels configure them
+func DefaultNotify() Notify {
+	return Notify{
+		Events:  []string{NotifyEventScale, NotifyEventError},
+		Retries: DefaultNotifyRetries,
+		Backoff: DefaultNotifyBackoff,
+	}
+}
+
+// ParseNotify returns the notification settings configured by the
+// auklet.notify.* labels, on top of the given defaults
+func ParseNotify(labels map[string]string, defaults Notify) (Notify, error) {
+	n := defaults
+	var err error
+
+	if v, isSet := labels[notifyLabelPrefix+"url"]; isSet {
+		n.URL = v
+	}
+	if v, isSet := labels[notifyLabelPrefix+"body"]; isSet {
+		n.Body = v
+	}
+	if v, isSet := labels[notifyLabelPrefix+"secret"]; isSet {
+		n.Secret = v
+	}
+
+	if v, isSet := labels[notifyLabelPrefix+"events"]; isSet {
+		n.Events = nil
+		for _, e := range strings.Split(v, ",") {
+			e = strings.TrimSpace(e)
+			if e != NotifyEventScale && e != NotifyEventError {
+				return n, fmt.Errorf("invalid value for %sevents: unknown event %q", notifyLabelPrefix, e)
+			}
+			n.Events = append(n.Events, e)
+		}
+	}
+
+	if v, isSet := labels[notifyLabelPrefix+"retries"]; isSet {
+		n.Retries, err = strconv.Atoi(v)
+		if err != nil {
+			return n, fmt.Errorf("invalid value for %sretries: %v", notifyLabelPrefix, err)
+		}
+		if n.Retries < 0 {
+			return n, fmt.Errorf("%sretries must not be negative", notifyLabelPrefix)
+		}
+	}
+
+	if v, isSet := labels[notifyLabelPrefix+"backoff"]; isSet {
+		n.Backoff, err = time.ParseDuration(v)
+		if err != nil {
+			return n, fmt.Errorf("invalid value for %sbackoff: %v", notifyLabelPrefix, err)
+		}
+	}
+
+	n.body = nil
+	if n.Body != "" {
+		n.body, err = template.New("notify").Funcs(template.FuncMap{"json": toJSON}).Parse(n.Body)
+		if err != nil {
+			return n, fmt.Errorf("invalid template in %sbody: %v", notifyLabelPrefix, err)
+		}
+		if _, err := n.render(Notification{}); err != nil {
+			return n, fmt.Errorf("invalid template in %sbody: %v", notifyLabelPrefix, err)
+		}
+	}
+
+	return n, nil
+}
+
+// toJSON encodes v as JSON, so templates can safely embed values, e.g.
+// `{"text": {{json .ServiceName}}}`
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// render returns the body of the notification
+func (n *Notify) render(e Notification) ([]byte, error) {
+	if n.body == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := n.body.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// wants returns whether notifications of the given event are sent
+func (n *Notify) wants(event string) bool {
+	if n.URL == "" {
+		return false
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends the notification of a service event to its webhook, if it
+// configured one for the event. Sending happens in the background, so a slow
+// webhook never delays the monitor.
+func (s *Service) notify(event string, to int, err error) {
+	if !s.Notify.wants(event) {
+		return
+	}
+
+	e := Notification{
+		Event:       event,
+		Time:        s.auklet.Clock.Now(),
+		ServiceID:   s.ServiceID,
+		ServiceName: s.ServiceName,
+		From:        s.CurrentReplicas,
+		To:          to,
+		Driver:      s.Driver,
+		Outcome:     s.outcome,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	body, err := s.Notify.render(e)
+	if err != nil {
+		log.WithField("service_id", s.ServiceID).WithError(err).Error("Failed to render notification")
+		return
+	}
+	go s.auklet.sendNotification(s.Notify, body)
+}
+
+// sendNotification posts the body to the webhook, retrying with exponential
+// backoff when it fails
+func (a *Auklet) sendNotification(n Notify, body []byte) {
+	logger := log.WithField("url", n.URL)
+	client := &http.Client{Timeout: notifyTimeout}
+	backoff := n.Backoff
+
+	for attempt := 0; ; attempt++ {
+		err := postNotification(client, n, body)
+		if err == nil {
+			a.Lock()
+			a.metrics[MetricNotificationsTotal].(prometheus.Counter).Inc()
+			a.Unlock()
+			return
+		}
+
+		if attempt >= n.Retries {
+			logger.WithError(err).Error("Failed to send notification")
+			a.Lock()
+			a.metrics[MetricNotificationErrorsTotal].(prometheus.Counter).Inc()
+			a.Unlock()
+			return
+		}
+
+		logger.WithError(err).WithField("retry_in", backoff).Warn("Failed to send notification, retrying")
+		<-a.Clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+// postNotification performs a single attempt to post the body to the webhook
+func postNotification(client *http.Client, n Notify, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package auklet
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// notificationServer starts a webhook that passes the notifications it
+// receives to the returned channel
+func notificationServer(t *testing.T) (*httptest.Server, <-chan Notification) {
+	received := make(chan Notification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("invalid notification: %v", err)
+		}
+		received <- n
+	}))
+	return server, received
+}
+
+func TestNotifyScale(t *testing.T) {
+	server, received := notificationServer(t)
+	defer server.Close()
+	e := newTestEnv(t, "notify-scale", 2, map[string]string{"auklet.notify.url": server.URL})
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	select {
+	case n := <-received:
+		if n.Event != NotifyEventScale || n.From != 2 || n.To != 3 || n.Outcome != OutcomeApplied {
+			t.Errorf("unexpected notification: %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+}
+
+func TestNotifyDryRun(t *testing.T) {
+	server, received := notificationServer(t)
+	defer server.Close()
+	e := newTestEnv(t, "notify-dry-run", 2, map[string]string{
+		"auklet.notify.url": server.URL,
+		"auklet.dry_run":    "true",
+	})
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	if e.svc.outcome != OutcomeDryRun {
+		t.Fatalf("expected a dry-run, got %q", e.svc.outcome)
+	}
+	select {
+	case n := <-received:
+		t.Errorf("unexpected notification: %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,28 @@
+package auklet
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/prometheus/common/model"
+	"time"
+)
+
+// Orchestrator is the part of the Docker API Auklet uses to find, inspect and
+// scale services. It is implemented by the Docker client, and by
+// FakeOrchestrator for testing.
+type Orchestrator interface {
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// MetricSource executes the PromQL queries Auklet bases its scaling decisions
+// on. It is implemented by the Prometheus API client, and by FakeMetricSource
+// for testing.
+type MetricSource interface {
+	Query(ctx context.Context, query string, ts time.Time) (model.Value, error)
+}
@@ -0,0 +1,45 @@
+package auklet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProfileLabel is the label that selects the profile a service uses
+const ProfileLabel = "auklet.profile"
+
+// MergeLabels returns the labels of a service on top of the labels of the
+// profile it selects with auklet.profile, on top of the default labels. The
+// auklet.autoscale label is only taken from the service, so autoscaling is
+// always enabled per service. The auklet.profile label is resolved, and not
+// part of the result. Profile names are case-insensitive, as the config file
+// lowercases them.
+func MergeLabels(defaults map[string]string, profiles map[string]map[string]string, labels map[string]string) (map[string]string, error) {
+	merged := make(map[string]string)
+	add := func(l map[string]string) {
+		for k, v := range l {
+			if k != "auklet.autoscale" && k != ProfileLabel {
+				merged[k] = v
+			}
+		}
+	}
+
+	add(defaults)
+	if name, isSet := labels[ProfileLabel]; isSet {
+		profile, found := profiles[name]
+		if !found {
+			profile, found = profiles[strings.ToLower(name)]
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid value for %s: unknown profile %q", ProfileLabel, name)
+		}
+		add(profile)
+	}
+
+	for k, v := range labels {
+		if k != ProfileLabel {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,114 @@
+package auklet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeLabels(t *testing.T) {
+	defaults := map[string]string{
+		"auklet.polling_interval": "1m",
+		"auklet.scale_min":        "1",
+		"auklet.scale_max":        "5",
+		"auklet.autoscale":        "true",
+	}
+	profiles := map[string]map[string]string{
+		"web": {
+			"auklet.scale_max":        "10",
+			"auklet.query":            "avg(cpu)",
+			"auklet.profile":          "other",
+			"auklet.up_threshold":     "80",
+			"auklet.autoscale":        "true",
+			"auklet.down_graceperiod": "5m",
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:   "defaults only",
+			labels: map[string]string{"auklet.autoscale": "true"},
+			expected: map[string]string{
+				"auklet.autoscale":        "true",
+				"auklet.polling_interval": "1m",
+				"auklet.scale_min":        "1",
+				"auklet.scale_max":        "5",
+			},
+		},
+		{
+			name: "labels over profile over defaults",
+			labels: map[string]string{
+				"auklet.profile":          "web",
+				"auklet.up_threshold":     "90",
+				"auklet.polling_interval": "10s",
+			},
+			expected: map[string]string{
+				"auklet.polling_interval": "10s",
+				"auklet.scale_min":        "1",
+				"auklet.scale_max":        "10",
+				"auklet.query":            "avg(cpu)",
+				"auklet.up_threshold":     "90",
+				"auklet.down_graceperiod": "5m",
+			},
+		},
+		{
+			name:   "profile names are case-insensitive",
+			labels: map[string]string{"auklet.profile": "Web", "auklet.autoscale": "false"},
+			expected: map[string]string{
+				"auklet.autoscale":        "false",
+				"auklet.polling_interval": "1m",
+				"auklet.scale_min":        "1",
+				"auklet.scale_max":        "10",
+				"auklet.query":            "avg(cpu)",
+				"auklet.up_threshold":     "80",
+				"auklet.down_graceperiod": "5m",
+			},
+		},
+		{
+			name:   "other labels are kept",
+			labels: map[string]string{"com.docker.stack.namespace": "shop"},
+			expected: map[string]string{
+				"com.docker.stack.namespace": "shop",
+				"auklet.polling_interval":    "1m",
+				"auklet.scale_min":           "1",
+				"auklet.scale_max":           "5",
+			},
+		},
+	} {
+		merged, err := MergeLabels(defaults, profiles, tc.labels)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(merged, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, merged)
+		}
+	}
+}
+
+func TestMergeLabelsUnknownProfile(t *testing.T) {
+	profiles := map[string]map[string]string{"web": {"auklet.scale_max": "10"}}
+
+	for _, name := range []string{"db", ""} {
+		_, err := MergeLabels(nil, profiles, map[string]string{"auklet.profile": name})
+		if err == nil || err.Error() != `invalid value for auklet.profile: unknown profile "`+name+`"` {
+			t.Errorf("%q: expected an unknown profile error, got %v", name, err)
+		}
+	}
+}
+
+func TestMergeLabelsDoesNotModifyInput(t *testing.T) {
+	defaults := map[string]string{"auklet.scale_min": "1"}
+	profiles := map[string]map[string]string{"web": {"auklet.scale_min": "2"}}
+	labels := map[string]string{"auklet.profile": "web", "auklet.scale_min": "3"}
+
+	if _, err := MergeLabels(defaults, profiles, labels); err != nil {
+		t.Fatal(err)
+	}
+	if defaults["auklet.scale_min"] != "1" || profiles["web"]["auklet.scale_min"] != "2" || labels["auklet.profile"] != "web" {
+		t.Errorf("expected the input to be unchanged, got %v, %v and %v", defaults, profiles, labels)
+	}
+}
@@ -5,12 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/api"
-	"github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"math"
 	"net/url"
-	"strconv"
-	"time"
 )
 
 // NewPrometheusAPI constructs a new Prometheus API object to use for querying
@@ -30,14 +28,39 @@ func NewPrometheusAPI(endpoint string) (api.Client, error) {
 	return client, nil
 }
 
+// Constants representing how the values of a query returning multiple series
+// are aggregated into a single value
+const (
+	AggregationFirst = "first"
+	AggregationSum   = "sum"
+	AggregationAvg   = "avg"
+	AggregationMax   = "max"
+	AggregationMin   = "min"
+)
+
+// Constants representing how a query returning no data is handled
+const (
+	// QueryEmptyError treats the query as failed
+	QueryEmptyError = "error"
+	// QueryEmptyZero uses 0 as value
+	QueryEmptyZero = "zero"
+	// QueryEmptyHold skips the poll without making a decision
+	QueryEmptyHold = "hold"
+)
+
+// errEmptyResult is returned by getMetric when the query returned no data
+var errEmptyResult = errors.New("query returned no data")
+
 // private function to execute a query against the Prometheus endpoint, and
-// return the metric
-func (a *Auklet) getMetric(ctx context.Context, query string) (float64, error) {
+// return the metric. When the query returns multiple series their values are
+// aggregated.
+func (a *Auklet) getMetric(ctx context.Context, query string, aggregation string) (float64, error) {
 	var result float64
-	pc := v1.NewAPI(*a.PrometheusClient)
-
-	value, err := pc.Query(ctx, query, time.Now())
+	value, err := a.PrometheusClient.Query(ctx, query, a.Clock.Now())
 	if err != nil {
+		a.Lock()
+		a.metrics[MetricPrometheusQueryErrorsTotal].(prometheus.Counter).Inc()
+		a.Unlock()
 		return result, fmt.Errorf("error executing Prometheus query: %v", err)
 	}
 
@@ -47,13 +70,42 @@ func (a *Auklet) getMetric(ctx context.Context, query string) (float64, error) {
 
 	switch value.Type() {
 	case model.ValVector:
-		result, err = strconv.ParseFloat(value.(model.Vector)[0].Value.String(), 64)
-		if err != nil {
-			return result, fmt.Errorf("could not get value: %v", err)
+		vector := value.(model.Vector)
+		if len(vector) == 0 {
+			return result, errEmptyResult
+		}
+		values := make([]float64, 0, len(vector))
+		for _, sample := range vector {
+			values = append(values, float64(sample.Value))
 		}
+		result = aggregate(values, aggregation)
+	case model.ValScalar:
+		result = float64(value.(*model.Scalar).Value)
 	default:
-		return result, errors.New("query returned multiple or wrong type of value(s)")
+		return result, fmt.Errorf("query returned unsupported type of value (%s)", value.Type())
 	}
 
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return result, fmt.Errorf("query returned %v", result)
+	}
 	return result, nil
 }
+
+// aggregate combines the values of multiple series into a single value
+func aggregate(values []float64, aggregation string) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		switch aggregation {
+		case AggregationSum, AggregationAvg:
+			result += v
+		case AggregationMax:
+			result = math.Max(result, v)
+		case AggregationMin:
+			result = math.Min(result, v)
+		}
+	}
+	if aggregation == AggregationAvg {
+		result /= float64(len(values))
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+package auklet
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		values      []float64
+		aggregation string
+		expected    float64
+	}{
+		{[]float64{3, 1, 2}, AggregationFirst, 3},
+		{[]float64{3, 1, 2}, AggregationSum, 6},
+		{[]float64{3, 1, 2}, AggregationAvg, 2},
+		{[]float64{3, 1, 2}, AggregationMax, 3},
+		{[]float64{3, 1, 2}, AggregationMin, 1},
+		{[]float64{-3, 1}, AggregationMax, 1},
+		{[]float64{-3, 1}, AggregationMin, -3},
+		{[]float64{5}, AggregationAvg, 5},
+		{[]float64{5}, AggregationSum, 5},
+	}
+
+	for _, test := range tests {
+		if v := aggregate(test.values, test.aggregation); v != test.expected {
+			t.Errorf("%s of %v: expected %g, got %g", test.aggregation, test.values, test.expected, v)
+		}
+	}
+}
+
+func TestGetMetric(t *testing.T) {
+	vector := func(values ...float64) model.Vector {
+		var v model.Vector
+		for _, f := range values {
+			v = append(v, &model.Sample{Value: model.SampleValue(f)})
+		}
+		return v
+	}
+
+	tests := []struct {
+		name        string
+		value       model.Value
+		aggregation string
+		expected    float64
+		err         bool
+	}{
+		{"single sample", vector(42), AggregationFirst, 42, false},
+		{"sum", vector(1, 2, 3), AggregationSum, 6, false},
+		{"avg", vector(1, 2, 3), AggregationAvg, 2, false},
+		{"min", vector(1, 2, 3), AggregationMin, 1, false},
+		{"max", vector(1, 2, 3), AggregationMax, 3, false},
+		{"scalar", &model.Scalar{Value: 7}, AggregationSum, 7, false},
+		{"empty vector", vector(), AggregationSum, 0, true},
+		{"NaN", vector(math.NaN()), AggregationFirst, 0, true},
+		{"NaN in sum", vector(1, math.NaN()), AggregationSum, 0, true},
+		{"NaN in max", vector(1, math.NaN()), AggregationMax, 0, true},
+		{"+Inf", vector(math.Inf(1)), AggregationFirst, 0, true},
+		{"-Inf in min", vector(1, math.Inf(-1)), AggregationMin, 0, true},
+		{"scalar NaN", &model.Scalar{Value: model.SampleValue(math.NaN())}, AggregationFirst, 0, true},
+		{"string", &model.String{Value: "42"}, AggregationFirst, 0, true},
+		{"matrix", model.Matrix{}, AggregationFirst, 0, true},
+	}
+
+	for _, test := range tests {
+		metrics := NewFakeMetricSource()
+		metrics.SetValue("q", test.value)
+		a := NewWithClients(NewFakeOrchestrator(), metrics, 0)
+
+		v, err := a.getMetric(context.Background(), "q", test.aggregation)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %g", test.name, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if v != test.expected {
+			t.Errorf("%s: expected %g, got %g", test.name, test.expected, v)
+		}
+	}
+
+	// An empty vector is reported as such, so query_empty can handle it
+	metrics := NewFakeMetricSource()
+	metrics.SetValue("q", vector())
+	a := NewWithClients(NewFakeOrchestrator(), metrics, 0)
+	if _, err := a.getMetric(context.Background(), "q", AggregationSum); err != errEmptyResult {
+		t.Errorf("expected errEmptyResult, got %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package auklet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/swarm"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleLabelPrefix is the prefix of labels that configure schedules, e.g.
+// auklet.schedule.workday=cron:0 8 * * 1-5;min=6;max=20;duration=10h
+const scheduleLabelPrefix = "auklet.schedule."
+
+// maxScheduleDuration limits how far back a schedule is searched for the time
+// it was last triggered.
+const maxScheduleDuration = 7 * 24 * time.Hour
+
+// Schedule temporarily overrides the minimum and/or maximum number of replicas
+// of a service. It becomes active whenever its cron expression triggers, and
+// stays active for Duration.
+type Schedule struct {
+	Name        string
+	Cron        string
+	MinReplicas int
+	MaxReplicas int
+	HasMin      bool
+	HasMax      bool
+	Duration    time.Duration
+	Location    *time.Location
+	cron        *cronExpr
+}
+
+// getServiceSchedules takes the service labels and returns all schedules
+// configured for the service, sorted by name.
+func getServiceSchedules(s *swarm.Service) ([]*Schedule, error) {
+	loc := time.Local
+	if v, isSet := s.Spec.Labels["auklet.schedule_timezone"]; isSet {
+		l, err := time.LoadLocation(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for auklet.schedule_timezone: %v", err)
+		}
+		loc = l
+	}
+
+	var schedules []*Schedule
+	for label, v := range s.Spec.Labels {
+		if !strings.HasPrefix(label, scheduleLabelPrefix) {
+			continue
+		}
+		sched, err := parseSchedule(label[len(scheduleLabelPrefix):], v, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", label, err)
+		}
+		schedules = append(schedules, sched)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules, nil
+}
+
+// parseSchedule parses a schedule definition of the form
+// `cron:<expr>;min=<int>;max=<int>;duration=<duration>[;tz=<location>]`
+func parseSchedule(name string, def string, loc *time.Location) (*Schedule, error) {
+	if name == "" {
+		return nil, errors.New("schedule name must be set")
+	}
+
+	sched := Schedule{Name: name, Location: loc}
+	for _, part := range strings.Split(def, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if strings.HasPrefix(part, "cron:") {
+			sched.Cron = strings.TrimSpace(part[len("cron:"):])
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid schedule option %q", part)
+		}
+
+		var err error
+		switch kv[0] {
+		case "min":
+			sched.MinReplicas, err = strconv.Atoi(kv[1])
+			sched.HasMin = true
+		case "max":
+			sched.MaxReplicas, err = strconv.Atoi(kv[1])
+			sched.HasMax = true
+		case "duration":
+			sched.Duration, err = time.ParseDuration(kv[1])
+		case "tz":
+			sched.Location, err = time.LoadLocation(kv[1])
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule option %q: %v", part, err)
+		}
+	}
+
+	if sched.Cron == "" {
+		return nil, errors.New("cron expression must be set")
+	}
+	c, err := parseCron(sched.Cron)
+	if err != nil {
+		return nil, err
+	}
+	sched.cron = c
+
+	if !sched.HasMin && !sched.HasMax {
+		return nil, errors.New("min and/or max must be set")
+	}
+	if sched.HasMin && sched.MinReplicas < 0 || sched.HasMax && sched.MaxReplicas < 0 {
+		return nil, errors.New("min and max must not be negative")
+	}
+	if sched.HasMin && sched.HasMax && sched.MinReplicas > sched.MaxReplicas {
+		return nil, errors.New("min must not be greater than max")
+	}
+	if sched.Duration <= 0 || sched.Duration > maxScheduleDuration {
+		return nil, fmt.Errorf("duration must be between 0s and %s", maxScheduleDuration)
+	}
+
+	return &sched, nil
+}
+
+// active returns true when the schedule was triggered less than Duration ago
+func (sc *Schedule) active(now time.Time) bool {
+	now = now.In(sc.Location)
+	for t := now.Truncate(time.Minute); now.Sub(t) < sc.Duration; t = t.Add(-time.Minute) {
+		if sc.cron.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// cronExpr is a parsed standard 5 field cron expression (minute, hour, day of
+// month, month, day of week). Each field is stored as a bit set.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// cronField describes the valid range of a cron expression field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses a standard 5 field cron expression. Fields support `*`,
+// single values, ranges (`1-5`), steps (`*/15`, `0-30/10`) and lists (`1,3,5`).
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields", expr, len(cronFields))
+	}
+
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+
+	// Both 0 and 7 represent Sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronExpr{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a single cron expression field into a bit set
+func parseCronField(field string, f cronField) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, item)
+			}
+			item = item[:i]
+		}
+
+		lo, hi := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s field %q", f.name, item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid %s field %q", f.name, item)
+				}
+			} else if step > 1 {
+				// `5/15` means every 15 starting at 5
+				hi = f.max
+			}
+		}
+
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s field %q out of range %d-%d", f.name, item, f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matches returns true when the cron expression triggers at time t (with
+// minute precision).
+func (c *cronExpr) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 ||
+		c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	// Like standard cron, when both day fields are restricted either one
+	// needs to match.
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
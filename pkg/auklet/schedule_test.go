@@ -0,0 +1,150 @@
+package auklet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestParseCronMatches(t *testing.T) {
+	// 2018-12-01 is a Saturday, 2018-12-02 a Sunday, 2018-12-03 a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2018, 12, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr  string
+		t     time.Time
+		match bool
+	}{
+		{"* * * * *", at(3, 12, 34), true},
+		{"*/15 * * * *", at(3, 12, 30), true},
+		{"*/15 * * * *", at(3, 12, 10), false},
+		{"5/15 * * * *", at(3, 12, 5), true},
+		{"5/15 * * * *", at(3, 12, 50), true},
+		{"5/15 * * * *", at(3, 12, 0), false},
+		{"0-30/10 * * * *", at(3, 12, 20), true},
+		{"0-30/10 * * * *", at(3, 12, 40), false},
+		{"0,30 8 * * *", at(3, 8, 30), true},
+		{"0,30 8 * * *", at(3, 9, 30), false},
+		{"0 8 * * 1-5", at(3, 8, 0), true},
+		{"0 8 * * 1-5", at(2, 8, 0), false},
+		// Both 0 and 7 are Sunday
+		{"0 0 * * 0", at(2, 0, 0), true},
+		{"0 0 * * 7", at(2, 0, 0), true},
+		{"0 0 * * 7", at(3, 0, 0), false},
+		// Only day of month restricted: it must match
+		{"0 0 1 * *", at(1, 0, 0), true},
+		{"0 0 1 * *", at(3, 0, 0), false},
+		// Both day fields restricted: either one matches
+		{"0 0 1 * 1", at(1, 0, 0), true},
+		{"0 0 1 * 1", at(3, 0, 0), true},
+		{"0 0 1 * 1", at(2, 0, 0), false},
+		{"0 0 * 11 *", at(3, 0, 0), false},
+		{"0 0 * 12 *", at(3, 0, 0), true},
+	}
+
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+		if match := c.matches(test.t); match != test.match {
+			t.Errorf("%q matches %s: expected %v, got %v", test.expr, test.t.Format(time.RFC1123), test.match, match)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): expected an error", expr)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	sc, err := parseSchedule("peak", "cron:0 12 * * *;min=5;duration=1h", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t      time.Time
+		active bool
+	}{
+		{testStart.Add(-time.Minute), false},
+		{testStart, true},
+		{testStart.Add(59 * time.Minute), true},
+		{testStart.Add(time.Hour), false},
+	}
+	for _, test := range tests {
+		if active := sc.active(test.t); active != test.active {
+			t.Errorf("active at %s: expected %v, got %v", test.t, test.active, active)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, def := range []string{
+		"min=5;duration=1h",
+		"cron:0 12 * * *;duration=1h",
+		"cron:0 12 * * *;min=5",
+		"cron:0 12 * * *;min=5;duration=200h",
+		"cron:0 12 * * *;min=5;max=4;duration=1h",
+		"cron:0 12 * * *;min=-1;duration=1h",
+		"cron:0 12 * * *;min=5;duration=1h;foo=bar",
+		"cron:0 12 * * *;min=5;duration=1h;tz=Nowhere/Special",
+	} {
+		if _, err := parseSchedule("test", def, time.UTC); err == nil {
+			t.Errorf("parseSchedule(%q): expected an error", def)
+		}
+	}
+}
+
+func TestScheduleFloorAppliedWhileQueryFails(t *testing.T) {
+	e := newTestEnv(t, "schedule-query-fails", 2, map[string]string{
+		"auklet.schedule.peak": "cron:0 12 * * *;min=5;duration=1h",
+	})
+	e.metrics.SetError("load", errors.New("prometheus down"))
+
+	e.poll()
+	e.expectReplicas(5)
+	if e.svc.MinReplicas != 5 {
+		t.Errorf("expected scheduled min of 5, got %d", e.svc.MinReplicas)
+	}
+
+	// After the schedule expired the base bounds apply again
+	e.pollAfter(time.Hour)
+	if e.svc.MinReplicas != 1 {
+		t.Errorf("expected min of 1 after the schedule expired, got %d", e.svc.MinReplicas)
+	}
+	e.expectReplicas(5)
+}
+
+func TestScheduleFloorAppliedWhileQueryHolds(t *testing.T) {
+	e := newTestEnv(t, "schedule-query-holds", 2, map[string]string{
+		"auklet.schedule.peak": "cron:0 12 * * *;min=5;duration=1h",
+		"auklet.query_empty":   QueryEmptyHold,
+	})
+	e.metrics.SetValue("load", model.Vector{})
+
+	e.poll()
+	e.expectReplicas(5)
+}
@@ -0,0 +1,151 @@
+package auklet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sample is the value of a metric at a point in time
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// SimulationStep is the outcome of a single poll of a simulated service
+type SimulationStep struct {
+	Time     time.Time          `json:"time"`
+	Values   map[string]float64 `json:"values"`
+	State    string             `json:"state"`
+	Replicas int                `json:"replicas"`
+	Decision *Decision          `json:"decision,omitempty"`
+}
+
+// errNoSample is returned by the simulated metric source before the first
+// sample of a series
+var errNoSample = errors.New("no sample in series yet")
+
+// Simulate replays metric series against the autoscaling configuration in
+// labels, using the same state machine as the daemon with a virtual clock.
+// The service is polled every polling interval from the first until the last
+// sample; each poll sees the last sample of every series at that time. series
+// is keyed by metric name, except when both the service and series contain a
+// single metric. The simulation starts with the given number of replicas, or
+// with scale_min when replicas is negative. Scale decisions are always
+// applied, even when auklet.dry_run is set, and no notifications are sent.
+func Simulate(labels map[string]string, replicas int, series map[string][]Sample) ([]SimulationStep, error) {
+	serviceLabels := make(map[string]string)
+	for k, v := range labels {
+		serviceLabels[k] = v
+	}
+	delete(serviceLabels, "auklet.dry_run")
+	for k := range serviceLabels {
+		if strings.HasPrefix(k, notifyLabelPrefix) {
+			delete(serviceLabels, k)
+		}
+	}
+
+	orchestrator := NewFakeOrchestrator()
+	metricSource := NewFakeMetricSource()
+	a := NewWithClients(orchestrator, metricSource, 0)
+
+	s := orchestrator.AddService("simulation", 0, serviceLabels)
+	svc, err := getService(a, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(svc.Metrics) == 1 && len(series) == 1 {
+		for _, samples := range series {
+			series = map[string][]Sample{svc.Metrics[0].Name: samples}
+		}
+	}
+
+	var start, end time.Time
+	for _, m := range svc.Metrics {
+		samples, found := series[m.Name]
+		if !found || len(samples) == 0 {
+			return nil, fmt.Errorf("no samples for metric %s", m.Name)
+		}
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+		if start.IsZero() || samples[0].Time.Before(start) {
+			start = samples[0].Time
+		}
+		if last := samples[len(samples)-1].Time; last.After(end) {
+			end = last
+		}
+	}
+
+	if replicas < 0 {
+		replicas = svc.BaseMinReplicas
+	}
+	r := uint64(replicas)
+	orchestrator.Services[s.ID].Spec.Mode.Replicated.Replicas = &r
+	svc.CurrentReplicas = replicas
+
+	clock := NewFakeClock(start)
+	a.Clock = clock
+	if err := a.createServiceMetrics(s.ID, s.Spec.Name); err != nil {
+		return nil, err
+	}
+	// The service metrics are registered globally, so remove them again for
+	// the next simulation
+	defer func() {
+		a.Lock()
+		a.deleteServiceMetrics(s.ID)
+		a.Unlock()
+	}()
+
+	ctx := context.Background()
+	logger := log.WithFields(log.Fields{"service_id": s.ID, "service_name": s.Spec.Name})
+
+	var steps []SimulationStep
+	for t := start; !t.After(end); t = t.Add(svc.PollInterval) {
+		clock.Set(t)
+		svc.CurrentReplicas = orchestrator.Replicas(s.ID)
+
+		values := make(map[string]float64)
+		for _, m := range svc.Metrics {
+			query, err := m.render(svc.queryContext())
+			if err != nil {
+				return nil, err
+			}
+			v, ok := sampleAt(series[m.Name], t)
+			if !ok {
+				metricSource.SetError(query, errNoSample)
+				continue
+			}
+			metricSource.Set(query, v)
+			values[m.Name] = v
+		}
+
+		a.pollService(ctx, svc, logger)
+
+		step := SimulationStep{
+			Time:     t,
+			Values:   values,
+			State:    svc.state.String(),
+			Replicas: orchestrator.Replicas(s.ID),
+		}
+		// Only a scale action of this poll is reported, not state changes
+		if d := svc.lastDecision(); d != nil && d.Time.Equal(t) && d.Outcome != "" {
+			step.Decision = d
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// sampleAt returns the value of the last sample at or before t
+func sampleAt(samples []Sample, t time.Time) (float64, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(t) })
+	if i == 0 {
+		return 0, false
+	}
+	return samples[i-1].Value, true
+}
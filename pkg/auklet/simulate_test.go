@@ -0,0 +1,150 @@
+package auklet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampleAt(t *testing.T) {
+	samples := []Sample{
+		{Time: testStart, Value: 1},
+		{Time: testStart.Add(time.Minute), Value: 2},
+		{Time: testStart.Add(2 * time.Minute), Value: 3},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		samples []Sample
+		t       time.Time
+		value   float64
+		ok      bool
+	}{
+		{"no samples", nil, testStart, 0, false},
+		{"before the first sample", samples, testStart.Add(-time.Second), 0, false},
+		{"at the first sample", samples, testStart, 1, true},
+		{"between samples", samples, testStart.Add(90 * time.Second), 2, true},
+		{"at a later sample", samples, testStart.Add(time.Minute), 2, true},
+		{"after the last sample", samples, testStart.Add(time.Hour), 3, true},
+	} {
+		v, ok := sampleAt(tc.samples, tc.t)
+		if v != tc.value || ok != tc.ok {
+			t.Errorf("%s: expected %g (%t), got %g (%t)", tc.name, tc.value, tc.ok, v, ok)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	series := map[string][]Sample{"cpu": {
+		{Time: testStart, Value: 50},
+		{Time: testStart.Add(time.Minute), Value: 90},
+		{Time: testStart.Add(150 * time.Second), Value: 10},
+	}}
+
+	steps, err := Simulate(testLabels(nil), 2, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A poll every 30s from the first until the last sample
+	expected := []struct {
+		value    float64
+		replicas int
+		from, to int
+	}{
+		{50, 2, 0, 0},
+		{50, 2, 0, 0},
+		{90, 3, 2, 3},
+		{90, 4, 3, 4},
+		{90, 5, 4, 5},
+		{10, 4, 5, 4},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(steps))
+	}
+	for i, exp := range expected {
+		step := steps[i]
+		if at := testStart.Add(time.Duration(i) * 30 * time.Second); !step.Time.Equal(at) {
+			t.Errorf("step %d: expected a poll at %s, got %s", i, at, step.Time)
+		}
+		// The single series is used for the single metric of the service
+		if v := step.Values[DefaultMetricName]; v != exp.value {
+			t.Errorf("step %d: expected value %g, got %g", i, exp.value, v)
+		}
+		if step.Replicas != exp.replicas {
+			t.Errorf("step %d: expected %d replicas, got %d", i, exp.replicas, step.Replicas)
+		}
+		if exp.from == 0 {
+			if step.Decision != nil {
+				t.Errorf("step %d: expected no scale action, got %+v", i, step.Decision)
+			}
+			continue
+		}
+		if d := step.Decision; d == nil || d.FromReplicas != exp.from || d.ToReplicas != exp.to || d.Outcome != OutcomeApplied {
+			t.Errorf("step %d: expected to scale %d -> %d, got %+v", i, exp.from, exp.to, d)
+		}
+	}
+}
+
+func TestSimulateGracePeriod(t *testing.T) {
+	series := map[string][]Sample{DefaultMetricName: {
+		{Time: testStart, Value: 90},
+		{Time: testStart.Add(2 * time.Minute), Value: 90},
+	}}
+
+	// Starts at scale_min, and even dry-run services are scaled
+	steps, err := Simulate(testLabels(map[string]string{
+		"auklet.up_graceperiod": "1m",
+		"auklet.dry_run":        "true",
+	}), -1, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replicas []int
+	for _, step := range steps {
+		replicas = append(replicas, step.Replicas)
+	}
+	expected := []int{1, 1, 2, 2, 2}
+	for i := range expected {
+		if i >= len(replicas) || replicas[i] != expected[i] {
+			t.Fatalf("expected replicas %v, got %v", expected, replicas)
+		}
+	}
+	if steps[1].State != "over_threshold" {
+		t.Errorf("expected the grace period to run, got state %s", steps[1].State)
+	}
+}
+
+func TestSimulateErrors(t *testing.T) {
+	series := map[string][]Sample{"cpu": {{Time: testStart, Value: 50}}}
+
+	if _, err := Simulate(map[string]string{"auklet.autoscale": "true"}, 1, series); err == nil {
+		t.Error("expected an error for an invalid configuration")
+	}
+
+	// Multiple metrics need a series per metric
+	labels := testLabels(map[string]string{
+		"auklet.metric.queue.query":          "queue",
+		"auklet.metric.queue.up_threshold":   "10",
+		"auklet.metric.queue.down_threshold": "1",
+	})
+	if _, err := Simulate(labels, 1, series); err == nil || err.Error() != "no samples for metric default" {
+		t.Errorf("expected an error for missing samples, got %v", err)
+	}
+}
+
+func TestSimulateRemovesMetrics(t *testing.T) {
+	series := map[string][]Sample{DefaultMetricName: {
+		{Time: testStart, Value: 90},
+		{Time: testStart.Add(time.Minute), Value: 90},
+	}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := Simulate(testLabels(nil), 1, series); err != nil {
+			t.Fatal(err)
+		}
+		if n := exportedSeries(t, "simulation"); n != 0 {
+			t.Fatalf("expected no series of the simulated service, got %d", n)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package auklet
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,48 +18,144 @@ const (
 	StateUnderThreshold
 	StateOverThreshold
 	StateScaling
+	StateCooldown
 )
 
+// Constants representing the scaling modes a Service can use
+const (
+	// ModeStep scales by a fixed number of replicas (UpStep/DownStep)
+	ModeStep = "step"
+	// ModeTarget computes the desired number of replicas proportionally to
+	// the ratio between the metric value and the TargetValue
+	ModeTarget = "target"
+)
+
+// Constants representing the policies applied when the Prometheus query of a
+// Service keeps failing
+const (
+	// OnErrorHold keeps the current number of replicas
+	OnErrorHold = "hold"
+	// OnErrorScaleUp adds UpStep replicas as a fail-safe
+	OnErrorScaleUp = "scale_up"
+	// OnErrorScaleDown removes DownStep replicas
+	OnErrorScaleDown = "scale_down"
+)
+
+// Constants representing the directions a cooldown period blocks scaling in
+const (
+	// CooldownScopeAny blocks scaling in any direction during a cooldown
+	CooldownScopeAny = "any"
+	// CooldownScopeSame only blocks scaling in the direction of the last
+	// scale action during a cooldown
+	CooldownScopeSame = "same"
+)
+
+// Constants representing scaling directions
+const (
+	directionNone = iota
+	directionUp
+	directionDown
+)
+
+// DefaultOnErrorAfter is the default number of consecutive query failures
+// after which the OnError policy is applied
+const DefaultOnErrorAfter = 3
+
+// DefaultTargetTolerance is the relative deviation from the target value that
+// is tolerated before target-tracking scales the service
+const DefaultTargetTolerance = 0.1
+
 type serviceState int
 
 // String implements Stringer interface for serviceState
 func (s serviceState) String() string {
 	switch s {
-	case StateStable: return "stable"
-	case StateOverThreshold: return "over_threshold"
-	case StateUnderThreshold: return "under_threshold"
-	case StateScaling: return "scaling"
-	default: return "unknown"
+	case StateStable:
+		return "stable"
+	case StateOverThreshold:
+		return "over_threshold"
+	case StateUnderThreshold:
+		return "under_threshold"
+	case StateScaling:
+		return "scaling"
+	case StateCooldown:
+		return "cooldown"
+	default:
+		return "unknown"
 	}
 }
 
 // Service is the finite state machine that represents a Swarm Service within
 // Auklet.
 type Service struct {
+	sync.Mutex
 	ServiceID       string
+	ServiceName     string
+	StackNamespace  string
 	PollInterval    time.Duration
 	CurrentReplicas int
+	DesiredReplicas int
 	MinReplicas     int
 	MaxReplicas     int
+	BaseMinReplicas int
+	BaseMaxReplicas int
+	Schedules       []*Schedule
+	ActiveSchedules []string
+	Mode            string
 	UpStep          int
 	DownStep        int
-	Query           string
-	UpThreshold     float64
-	DownThreshold   float64
+	Metrics         []*Metric
+	Driver          string
+	TargetTolerance float64
 	UpGracePeriod   time.Duration
 	DownGracePeriod time.Duration
 	GraceTimer      time.Time
+	UpCooldown      time.Duration
+	DownCooldown    time.Duration
+	CooldownScope   string
+	CooldownUntil   time.Time
+	cooldownDir     int
+	OnError         string
+	OnErrorAfter    int
+	Failures        int
+	LastPoll        time.Time
+	DryRun          bool
+	Notify          Notify
+	History         []Decision
+	ConfigError     string
 	auklet          *Auklet
 	state           serviceState
+	outcome         ScaleOutcome
+	scaleFailing    bool
+	labels          map[string]string
 }
 
 // getService takes service labels and copies/normalizes/validates them
-// into a Service struct
+// into a Service struct. Inconsistent configurations are rejected with an
+// error listing all problems.
 func getService(a *Auklet, s *swarm.Service) (*Service, error) {
+	// Labels from the profile and defaults are used as if they were set on
+	// the service; only the labels of the service itself are tracked for
+	// changes.
+	labels, err := MergeLabels(a.Defaults, a.Profiles, s.Spec.Labels)
+	if err != nil {
+		return &Service{}, err
+	}
+	serviceLabels := autoscaleLabels(s.Spec.Labels)
+	merged := *s
+	merged.Spec.Labels = labels
+	s = &merged
 
-	pollingInterval := 30 * time.Second
-	if v, isSet := s.Spec.Labels["auklet.polling_interval"]; isSet {
-		pollingInterval, _ = time.ParseDuration(v)
+	if errs := validateConfig(s.Spec.Labels); len(errs) > 0 {
+		return &Service{}, configError(errs)
+	}
+	if _, ok := serviceReplicas(s); !ok {
+		return &Service{}, errors.New("service is not in replicated mode")
+	}
+
+	pollingInterval, err := getServiceLabelDurationVal(s, "auklet.polling_interval", 30*time.Second)
+	if err != nil {
+		return &Service{}, err
 	}
 
 	scaleMin, err := getServiceLabelIntVal(s, "auklet.scale_min")
@@ -80,63 +178,196 @@ func getService(a *Auklet, s *swarm.Service) (*Service, error) {
 		return &Service{}, err
 	}
 
-	upThreshold, err := getServiceLabelFloatVal(s, "auklet.up_threshold")
+	dryRun := false
+	if v, isSet := s.Spec.Labels["auklet.dry_run"]; isSet {
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			return &Service{}, fmt.Errorf("invalid value for auklet.dry_run: %v", err)
+		}
+	}
+
+	schedules, err := getServiceSchedules(s)
+	if err != nil {
+		return &Service{}, err
+	}
+
+	mode := ModeStep
+	if v, isSet := s.Spec.Labels["auklet.mode"]; isSet {
+		mode = v
+	}
+
+	var targetTolerance float64
+	switch mode {
+	case ModeStep:
+	case ModeTarget:
+		targetTolerance, err = getServiceLabelFloatVal(s, "auklet.target_tolerance", DefaultTargetTolerance)
+		if err != nil {
+			return &Service{}, err
+		}
+	default:
+		return &Service{}, fmt.Errorf("invalid value for auklet.mode: %q", mode)
+	}
+
+	metrics, err := getServiceMetrics(s, mode, targetTolerance)
 	if err != nil {
 		return &Service{}, err
 	}
 
-	downThreshold, err := getServiceLabelFloatVal(s, "auklet.down_threshold")
+	upGracePeriod, err := getServiceLabelDurationVal(s, "auklet.up_graceperiod", 0)
 	if err != nil {
 		return &Service{}, err
 	}
 
-	upGracePeriod, err := time.ParseDuration(s.Spec.Labels["auklet.up_graceperiod"])
+	downGracePeriod, err := getServiceLabelDurationVal(s, "auklet.down_graceperiod", 0)
 	if err != nil {
-		upGracePeriod = 0
+		return &Service{}, err
 	}
 
-	downGracePeriod, err := time.ParseDuration(s.Spec.Labels["auklet.down_graceperiod"])
+	upCooldown, err := getServiceLabelDurationVal(s, "auklet.up_cooldown", 0)
 	if err != nil {
-		downGracePeriod = 0
+		return &Service{}, err
 	}
 
-	query := ""
-	if v, isSet := s.Spec.Labels["auklet.query"]; isSet {
-		query = v
-	} else {
-		return &Service{}, errors.New("auklet.query must be set")
+	downCooldown, err := getServiceLabelDurationVal(s, "auklet.down_cooldown", 0)
+	if err != nil {
+		return &Service{}, err
+	}
+
+	cooldownScope := CooldownScopeAny
+	if v, isSet := s.Spec.Labels["auklet.cooldown_scope"]; isSet {
+		cooldownScope = v
+	}
+
+	onError := OnErrorHold
+	if v, isSet := s.Spec.Labels["auklet.on_error"]; isSet {
+		onError = v
+	}
+
+	onErrorAfter, err := getServiceLabelIntVal(s, "auklet.on_error_after", DefaultOnErrorAfter)
+	if err != nil {
+		return &Service{}, err
+	}
+
+	notify, err := ParseNotify(s.Spec.Labels, a.Notify)
+	if err != nil {
+		return &Service{}, err
 	}
 
 	svc := Service{
 		ServiceID:       s.ID,
+		ServiceName:     s.Spec.Name,
+		StackNamespace:  s.Spec.Labels[StackNamespaceLabel],
 		PollInterval:    pollingInterval,
 		MinReplicas:     scaleMin,
 		MaxReplicas:     scaleMax,
+		BaseMinReplicas: scaleMin,
+		BaseMaxReplicas: scaleMax,
+		Schedules:       schedules,
+		Mode:            mode,
 		UpStep:          upStep,
 		DownStep:        downStep,
-		Query:           query,
-		UpThreshold:     upThreshold,
-		DownThreshold:   downThreshold,
+		Metrics:         metrics,
+		TargetTolerance: targetTolerance,
 		UpGracePeriod:   upGracePeriod,
 		DownGracePeriod: downGracePeriod,
+		UpCooldown:      upCooldown,
+		DownCooldown:    downCooldown,
+		CooldownScope:   cooldownScope,
+		OnError:         onError,
+		OnErrorAfter:    onErrorAfter,
+		DryRun:          dryRun,
+		Notify:          notify,
 		auklet:          a,
 		state:           StateStable,
+		labels:          serviceLabels,
 	}
 
 	log.Debugf("PollingInterval: %s", pollingInterval.String())
 	log.Debugf("MinReplicas:     %d", scaleMin)
 	log.Debugf("MaxReplicas:     %d", scaleMax)
+	for _, sc := range schedules {
+		log.Debugf("Schedule:        %s (%s)", sc.Name, sc.Cron)
+	}
+	log.Debugf("Mode:            %s", mode)
 	log.Debugf("UpStep:          %d", upStep)
 	log.Debugf("downStep:        %d", downStep)
-	log.Debugf("Query:           %s", query)
-	log.Debugf("UpThreshold:     %f", upThreshold)
-	log.Debugf("DownThreshold:   %f", downThreshold)
+	for _, m := range metrics {
+		log.Debugf("Metric:          %s", m.Name)
+		log.Debugf("  Query:         %s", m.Query)
+		log.Debugf("  UpThreshold:   %f", m.UpThreshold)
+		log.Debugf("  DownThreshold: %f", m.DownThreshold)
+		log.Debugf("  TargetValue:   %f", m.TargetValue)
+	}
+	log.Debugf("TargetTolerance: %f", targetTolerance)
 	log.Debugf("UpGracePeriod:   %s", upGracePeriod.String())
 	log.Debugf("DownGracePeriod: %s", downGracePeriod.String())
+	log.Debugf("UpCooldown:      %s", upCooldown.String())
+	log.Debugf("DownCooldown:    %s", downCooldown.String())
+	log.Debugf("CooldownScope:   %s", cooldownScope)
+	log.Debugf("OnError:         %s", onError)
+	log.Debugf("OnErrorAfter:    %d", onErrorAfter)
+	log.Debugf("DryRun:          %t", dryRun)
 
 	return &svc, nil
 }
 
+// getInvalidService returns a Service for a service with an invalid
+// autoscaling configuration. It is never polled, but keeps the service and the
+// reason its configuration was rejected visible until it's fixed.
+func getInvalidService(a *Auklet, s *swarm.Service, err error) *Service {
+	svc := Service{
+		ServiceID:   s.ID,
+		ServiceName: s.Spec.Name,
+		ConfigError: err.Error(),
+		auklet:      a,
+		state:       StateStable,
+		labels:      autoscaleLabels(s.Spec.Labels),
+	}
+	svc.CurrentReplicas, _ = serviceReplicas(s)
+	return &svc
+}
+
+// applySchedules determines which schedules are active at time now, and sets
+// the minimum and maximum number of replicas accordingly. Active schedules
+// override the bounds from the scale_min/scale_max labels; when multiple
+// schedules are active the highest bounds win.
+func (s *Service) applySchedules(now time.Time) {
+	var active []string
+	min, max := s.BaseMinReplicas, s.BaseMaxReplicas
+	hasMin, hasMax := false, false
+
+	for _, sc := range s.Schedules {
+		if !sc.active(now) {
+			continue
+		}
+		active = append(active, sc.Name)
+		if sc.HasMin && (!hasMin || sc.MinReplicas > min) {
+			min, hasMin = sc.MinReplicas, true
+		}
+		if sc.HasMax && (!hasMax || sc.MaxReplicas > max) {
+			max, hasMax = sc.MaxReplicas, true
+		}
+	}
+
+	if max < min {
+		// A raised floor always wins over the ceiling
+		max = min
+	}
+
+	if min != s.MinReplicas || max != s.MaxReplicas {
+		log.WithFields(log.Fields{
+			"service_id":   s.ServiceID,
+			"schedules":    active,
+			"min_replicas": min,
+			"max_replicas": max,
+		}).Info("Replica bounds changed by schedule")
+	}
+
+	s.ActiveSchedules = active
+	s.MinReplicas = min
+	s.MaxReplicas = max
+}
+
 // stable is called whenever the service enters "stable" (again)
 func (s *Service) stable() {
 	log.Debug("Service stable")
@@ -145,69 +376,327 @@ func (s *Service) stable() {
 	s.state = StateStable
 }
 
-// overThreshold is called whenever the service's Prometheus query
-// returned a metric value that is over the defined UpThreshold
-func (s *Service) overThreshold() {
-	log.Debug("Service over threshold")
-	if s.state == StateStable || s.state == StateUnderThreshold {
+// evaluate compares the last values of all metrics against their thresholds
+// and emits the resulting event. The service is over threshold when any of the
+// metrics is over threshold, and only under threshold when all metrics are.
+func (s *Service) evaluate(ctx context.Context) {
+	var over, under []*Metric
+	for _, m := range s.Metrics {
+		if m.over() {
+			over = append(over, m)
+		} else if m.under() {
+			under = append(under, m)
+		}
+	}
+
+	if len(over) > 0 {
+		if s.coolingDown(directionUp) {
+			log.Debug("Service in cooldown; not scaling up")
+			return
+		}
+		log.Debug("Emitting 'over_threshold' event")
+		s.overThreshold(ctx, s.driver(over))
+	} else if len(under) == len(s.Metrics) {
+		if s.coolingDown(directionDown) {
+			log.Debug("Service in cooldown; not scaling down")
+			return
+		}
+		log.Debug("Emitting 'under_threshold' event")
+		s.underThreshold(ctx, s.driver(under))
+	} else if s.state != StateCooldown || !s.coolingDown(directionNone) {
+		log.Debug("Emitting 'stable' event")
+		s.stable()
+	}
+}
+
+// coolingDown returns true when the service is in a cooldown period that
+// blocks scaling in the given direction. Passing directionNone checks whether
+// the service is in a cooldown period at all. When the cooldown period has
+// expired the service leaves the cooldown state.
+func (s *Service) coolingDown(direction int) bool {
+	if s.CooldownUntil.IsZero() {
+		return false
+	}
+
+	if !s.auklet.Clock.Now().Before(s.CooldownUntil) {
+		log.Debug("Cooldown period expired")
+		s.CooldownUntil = time.Time{}
+		s.setCooldownMetric()
+		if s.state == StateCooldown {
+			s.stable()
+		}
+		return false
+	}
+
+	return direction == directionNone || s.CooldownScope == CooldownScopeAny || direction == s.cooldownDir
+}
+
+// cooldown is called after scaling, and enters the cooldown state when a
+// cooldown period is configured for the scale direction
+func (s *Service) cooldown(direction int) bool {
+	period := s.UpCooldown
+	if direction == directionDown {
+		period = s.DownCooldown
+	}
+	if period <= 0 {
+		return false
+	}
+
+	log.WithField("cooldown", period.String()).Debug("Service cooling down")
+	s.GraceTimer = time.Time{}
+	s.state = StateCooldown
+	s.CooldownUntil = s.auklet.Clock.Now().Add(period)
+	s.cooldownDir = direction
+	s.setCooldownMetric()
+	return true
+}
+
+// setCooldownMetric exposes whether the service is in a cooldown period
+func (s *Service) setCooldownMetric() {
+	v := 0.0
+	if !s.CooldownUntil.IsZero() {
+		v = 1
+	}
+	s.auklet.setServiceMetric(s.ServiceID, MetricCooldown, v)
+}
+
+// driver picks the metric that drives the scaling decision from the given
+// metrics. In target mode this is the metric that requires the most replicas,
+// otherwise it's the first metric by name.
+func (s *Service) driver(metrics []*Metric) *Metric {
+	d := metrics[0]
+	if s.Mode == ModeTarget {
+		for _, m := range metrics[1:] {
+			if m.targetReplicas(s.CurrentReplicas) > d.targetReplicas(s.CurrentReplicas) {
+				d = m
+			}
+		}
+	}
+	return d
+}
+
+// overThreshold is called whenever the value of the driving metric m is over
+// its UpThreshold
+func (s *Service) overThreshold(ctx context.Context, m *Metric) {
+	log.WithFields(log.Fields{"metric": m.Name, "value": m.Value}).Debug("Service over threshold")
+	if s.state == StateStable || s.state == StateUnderThreshold || s.state == StateCooldown {
 		// Reset last time over threshold
 		log.Debug("Resetting grace timer")
-		s.GraceTimer = time.Now()
+		s.GraceTimer = s.auklet.Clock.Now()
 	}
 	s.state = StateOverThreshold
-	if time.Now().Sub(s.GraceTimer) >= s.UpGracePeriod {
-		r := 0
-		if s.CurrentReplicas+s.UpStep <= s.MaxReplicas {
-			r = s.CurrentReplicas + s.UpStep
-		} else {
+	s.Driver = m.Name
+	if s.auklet.Clock.Now().Sub(s.GraceTimer) >= s.UpGracePeriod {
+		r := s.CurrentReplicas + s.UpStep
+		if s.Mode == ModeTarget {
+			r = m.targetReplicas(s.CurrentReplicas)
+		}
+		if r > s.MaxReplicas {
 			r = s.MaxReplicas
 		}
-		s.scale(r)
+		s.scale(ctx, r)
 	} else {
-		log.Debugf("Service in grace period (%s)", time.Now().Sub(s.GraceTimer).String())
+		log.Debugf("Service in grace period (%s)", s.auklet.Clock.Now().Sub(s.GraceTimer).String())
 	}
 }
 
-// underThreshold is called whenever the service's Prometheus query
-// returned a metric value that is under the defined DownThreshold
-func (s *Service) underThreshold() {
-	log.Debug("Service under threshold")
-	if s.state == StateStable || s.state == StateOverThreshold {
+// underThreshold is called whenever the values of all metrics are under their
+// DownThreshold; m is the metric driving the decision
+func (s *Service) underThreshold(ctx context.Context, m *Metric) {
+	log.WithFields(log.Fields{"metric": m.Name, "value": m.Value}).Debug("Service under threshold")
+	if s.state == StateStable || s.state == StateOverThreshold || s.state == StateCooldown {
 		// Reset last time under threshold
-		s.GraceTimer = time.Now()
+		s.GraceTimer = s.auklet.Clock.Now()
 	}
 	s.state = StateUnderThreshold
-	if time.Now().Sub(s.GraceTimer) >= s.DownGracePeriod {
-		r := 0
-		if s.CurrentReplicas-s.DownStep >= s.MinReplicas {
-			r = s.CurrentReplicas - s.DownStep
-		} else {
+	s.Driver = m.Name
+	if s.auklet.Clock.Now().Sub(s.GraceTimer) >= s.DownGracePeriod {
+		r := s.CurrentReplicas - s.DownStep
+		if s.Mode == ModeTarget {
+			r = m.targetReplicas(s.CurrentReplicas)
+		}
+		if r < s.MinReplicas {
 			r = s.MinReplicas
 		}
-		s.scale(r)
+		s.scale(ctx, r)
 	} else {
-		log.Debugf("Service in grace period (%s)", time.Now().Sub(s.GraceTimer).String())
+		log.Debugf("Service in grace period (%s)", s.auklet.Clock.Now().Sub(s.GraceTimer).String())
+	}
+}
+
+// querySucceeded is called whenever the service's Prometheus query returned a
+// usable metric value, and resets the consecutive failure count
+func (s *Service) querySucceeded() {
+	s.Failures = 0
+	s.setFailuresMetric()
+}
+
+// queryFailed is called whenever the service's Prometheus query failed. No
+// scaling decision is made based on the failed query; only after OnErrorAfter
+// consecutive failures the OnError policy is applied (and again after every
+// next OnErrorAfter failures).
+func (s *Service) queryFailed(ctx context.Context, err error) {
+	s.Failures++
+	s.setFailuresMetric()
+	log.WithField("failures", s.Failures).Debug("Service query failed")
+
+	if s.Failures%s.OnErrorAfter != 0 {
+		return
+	}
+	s.notify(NotifyEventError, s.CurrentReplicas, err)
+
+	s.Driver = ""
+	switch s.OnError {
+	case OnErrorScaleUp:
+		if s.coolingDown(directionUp) {
+			log.WithField("failures", s.Failures).Warn("Query keeps failing; in cooldown, not scaling up")
+			return
+		}
+		log.WithField("failures", s.Failures).Warn("Query keeps failing; fail-safe scaling up")
+		r := s.CurrentReplicas + s.UpStep
+		if r > s.MaxReplicas {
+			r = s.MaxReplicas
+		}
+		s.scale(ctx, r)
+	case OnErrorScaleDown:
+		if s.coolingDown(directionDown) {
+			log.WithField("failures", s.Failures).Warn("Query keeps failing; in cooldown, not scaling down")
+			return
+		}
+		log.WithField("failures", s.Failures).Warn("Query keeps failing; scaling down")
+		r := s.CurrentReplicas - s.DownStep
+		if r < s.MinReplicas {
+			r = s.MinReplicas
+		}
+		s.scale(ctx, r)
+	default:
+		log.WithField("failures", s.Failures).Warn("Query keeps failing; holding replicas")
 	}
 }
 
-// scale is called whenever the service actually needs scaling
-func (s *Service) scale(replicas int) {
-	log.WithField("replicas", replicas).Debug("Service scaling")
+// setFailuresMetric exposes the number of consecutive query failures
+func (s *Service) setFailuresMetric() {
+	s.auklet.setServiceMetric(s.ServiceID, MetricQueryFailures, float64(s.Failures))
+}
+
+// scale is called whenever the service actually needs scaling. Only when the
+// service was scaled (or would have been, in dry-run) the scale event is
+// recorded and counted. When the service wasn't ready to be scaled, or
+// updating it failed, the state is kept so the scale action is retried on the
+// next poll.
+func (s *Service) scale(ctx context.Context, replicas int) {
+	log.WithFields(log.Fields{"replicas": replicas, "metric": s.Driver}).Debug("Service scaling")
+	s.DesiredReplicas = replicas
+	if s.CurrentReplicas == replicas {
+		s.stable()
+		return
+	}
+
+	dryRun := s.DryRun || s.auklet.DryRun
+	var err error
+	if dryRun {
+		s.outcome = OutcomeDryRun
+		log.WithFields(log.Fields{
+			"service_id": s.ServiceID,
+			"from":       s.CurrentReplicas,
+			"replicas":   replicas,
+			"metric":     s.Driver,
+		}).Info("dry-run: not scaling service")
+	} else {
+		s.outcome, err = s.auklet.scaleService(ctx, s.ServiceID, replicas, s.annotations(replicas))
+	}
+
+	switch s.outcome {
+	case OutcomeDeferred:
+		// Keep the current state, including a running grace period
+		return
+	case OutcomeFailed:
+		log.WithField("service_id", s.ServiceID).WithError(err).Error("Failed to scale service, retrying on next poll")
+		// Only notify about the first of a series of failed attempts
+		if !s.scaleFailing {
+			s.notify(NotifyEventScale, replicas, err)
+		}
+		s.scaleFailing = true
+		return
+	case OutcomeRejected:
+		log.WithField("service_id", s.ServiceID).WithError(err).Error("Service can't be scaled")
+		s.notify(NotifyEventScale, replicas, err)
+		s.stable()
+		return
+	}
+
 	s.state = StateScaling
-	if s.CurrentReplicas != replicas {
-		s.auklet.scaleService(s.ServiceID, replicas)
+	if dryRun {
+		s.auklet.incServiceMetric(s.ServiceID, MetricDryRunScaleEventsCount)
+	} else {
 		s.auklet.Lock()
 		s.auklet.metrics[MetricServiceScaleEventsTotal].(prometheus.Counter).Inc()
+		s.auklet.Unlock()
 		if replicas > s.CurrentReplicas {
-			s.auklet.serviceMetrics[s.ServiceID][MetricScaleUpEventsCount].(prometheus.Counter).Inc()
+			s.auklet.incServiceMetric(s.ServiceID, MetricScaleUpEventsCount)
 		} else {
-			s.auklet.serviceMetrics[s.ServiceID][MetricScaleDownEventsCount].(prometheus.Counter).Inc()
+			s.auklet.incServiceMetric(s.ServiceID, MetricScaleDownEventsCount)
+		}
+	}
+	if !dryRun {
+		s.notify(NotifyEventScale, replicas, nil)
+	}
+
+	// after scaling cool down, or return to stable state
+	direction := directionDown
+	if replicas > s.CurrentReplicas {
+		direction = directionUp
+	}
+	if !s.cooldown(direction) {
+		s.stable()
+	}
+}
+
+// setMetrics exposes the current state of the service, its replicas and its
+// metrics in the service specific gauges
+func (s *Service) setMetrics() {
+	a := s.auklet
+	a.setServiceMetric(s.ServiceID, MetricCurrentReplicas, float64(s.CurrentReplicas))
+	a.setServiceMetric(s.ServiceID, MetricDesiredReplicas, float64(s.DesiredReplicas))
+	a.setServiceMetric(s.ServiceID, MetricMinReplicas, float64(s.MinReplicas))
+	a.setServiceMetric(s.ServiceID, MetricMaxReplicas, float64(s.MaxReplicas))
+
+	for st := serviceState(StateStable); st <= StateCooldown; st++ {
+		v := 0.0
+		if s.state == st {
+			v = 1
+		}
+		a.setServiceMetric(s.ServiceID, MetricState, v, st.String())
+	}
+
+	remaining := time.Duration(0)
+	if !s.GraceTimer.IsZero() {
+		period := s.UpGracePeriod
+		if s.state == StateUnderThreshold {
+			period = s.DownGracePeriod
+		}
+		if r := period - s.auklet.Clock.Now().Sub(s.GraceTimer); r > 0 {
+			remaining = r
 		}
-		s.auklet.Unlock()
 	}
+	a.setServiceMetric(s.ServiceID, MetricGraceRemaining, remaining.Seconds())
+
+	for _, m := range s.Metrics {
+		a.setServiceMetric(s.ServiceID, MetricValue, m.Value, m.Name)
+		a.setServiceMetric(s.ServiceID, MetricUpThreshold, m.UpThreshold, m.Name)
+		a.setServiceMetric(s.ServiceID, MetricDownThreshold, m.DownThreshold, m.Name)
+	}
+}
 
-	// after scaling return to stable state
-	s.stable()
+// queryContext returns the variables available in the query templates of the
+// service
+func (s *Service) queryContext() QueryContext {
+	return QueryContext{
+		ServiceName:    s.ServiceName,
+		ServiceID:      s.ServiceID,
+		StackNamespace: s.StackNamespace,
+		Replicas:       s.CurrentReplicas,
+	}
 }
 
 // getServiceLabelIntVal takes the swarm service and tries to find a specific
@@ -229,6 +718,29 @@ func getServiceLabelIntVal(s *swarm.Service, label string, defVal ...int) (int,
 	return val, nil
 }
 
+// getServiceLabelDurationVal takes the swarm service and tries to find a
+// specific service label. It will then try to parse the duration from it, or
+// return the default value. If no default value specified, an error will be
+// returned.
+func getServiceLabelDurationVal(s *swarm.Service, label string, defVal ...time.Duration) (time.Duration, error) {
+	var val time.Duration
+	var err error
+	if v, isSet := s.Spec.Labels[label]; isSet {
+		val, err = time.ParseDuration(v)
+		if err != nil {
+			return val, fmt.Errorf("invalid value for %s: %v", label, err)
+		}
+		if val < 0 {
+			return val, fmt.Errorf("invalid value for %s: must not be negative", label)
+		}
+	} else if len(defVal) == 0 {
+		return val, fmt.Errorf("%s must be set", label)
+	} else {
+		val = defVal[0]
+	}
+	return val, nil
+}
+
 // getServiceLabelFloatVal takes the swarm service and tries to find a specific
 // service label. It will then try to take the float64 value from it, or return
 // the default value. If no default value specified, an error will be returned.
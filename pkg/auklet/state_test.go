@@ -0,0 +1,379 @@
+package auklet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestPollScalesUp(t *testing.T) {
+	e := newTestEnv(t, "state-scale-up", 2, map[string]string{"auklet.up_step": "2"})
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	e.expectReplicas(4)
+	e.expectState(StateStable)
+	if h := e.svc.History; len(h) != 1 || h[0].FromReplicas != 2 || h[0].ToReplicas != 4 || h[0].Outcome != OutcomeApplied {
+		t.Errorf("expected a single 2 -> 4 decision, got %v", h)
+	}
+
+	// The next poll sees the new number of replicas
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(6)
+}
+
+func TestPollScalesDown(t *testing.T) {
+	e := newTestEnv(t, "state-scale-down", 3, nil)
+	e.metrics.Set("load", 10)
+
+	e.poll()
+	e.expectReplicas(2)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(1)
+
+	// Never below scale_min
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(1)
+	if n := e.orchestrator.Updates; n != 2 {
+		t.Errorf("expected 2 updates, got %d", n)
+	}
+}
+
+func TestPollStaysWithinThresholds(t *testing.T) {
+	e := newTestEnv(t, "state-stable", 3, nil)
+	e.metrics.Set("load", 50)
+
+	e.poll()
+	e.expectReplicas(3)
+	e.expectState(StateStable)
+	if n := e.orchestrator.Updates; n != 0 {
+		t.Errorf("expected no updates, got %d", n)
+	}
+}
+
+func TestPollEnforcesBounds(t *testing.T) {
+	e := newTestEnv(t, "state-bounds", 12, nil)
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	e.expectReplicas(10)
+}
+
+func TestPollGracePeriod(t *testing.T) {
+	e := newTestEnv(t, "state-grace", 2, map[string]string{"auklet.up_graceperiod": "1m"})
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	e.expectState(StateOverThreshold)
+	e.expectReplicas(2)
+
+	e.pollAfter(30 * time.Second)
+	e.expectState(StateOverThreshold)
+	e.expectReplicas(2)
+
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	e.expectState(StateStable)
+}
+
+func TestPollGracePeriodReset(t *testing.T) {
+	e := newTestEnv(t, "state-grace-reset", 2, map[string]string{"auklet.up_graceperiod": "1m"})
+	e.metrics.Set("load", 90)
+	e.poll()
+
+	// Dropping within the thresholds resets the grace period
+	e.metrics.Set("load", 50)
+	e.pollAfter(30 * time.Second)
+	e.expectState(StateStable)
+
+	e.metrics.Set("load", 90)
+	e.pollAfter(30 * time.Second)
+	e.expectState(StateOverThreshold)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(2)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+}
+
+func TestPollQueryFailureHolds(t *testing.T) {
+	e := newTestEnv(t, "state-query-fails", 2, nil)
+	e.metrics.SetError("load", errors.New("prometheus down"))
+
+	for i := 0; i < 5; i++ {
+		e.pollAfter(30 * time.Second)
+	}
+	e.expectReplicas(2)
+	if e.svc.Failures != 5 {
+		t.Errorf("expected 5 failures, got %d", e.svc.Failures)
+	}
+
+	e.metrics.Set("load", 50)
+	e.pollAfter(30 * time.Second)
+	if e.svc.Failures != 0 {
+		t.Errorf("expected failures to be reset, got %d", e.svc.Failures)
+	}
+}
+
+func TestPollOnErrorScaleUp(t *testing.T) {
+	e := newTestEnv(t, "state-on-error", 2, map[string]string{
+		"auklet.on_error":       OnErrorScaleUp,
+		"auklet.on_error_after": "1",
+		"auklet.scale_max":      "5",
+	})
+	e.metrics.SetError("load", errors.New("prometheus down"))
+
+	for i := 0; i < 4; i++ {
+		e.pollAfter(30 * time.Second)
+	}
+
+	// Every failure adds a replica, until scale_max
+	e.expectReplicas(5)
+	if n := e.orchestrator.Updates; n != 3 {
+		t.Errorf("expected 3 updates, got %d", n)
+	}
+	if n := len(e.svc.History); n != 3 {
+		t.Errorf("expected 3 decisions, got %d", n)
+	}
+}
+
+func TestPollPausedAndPinned(t *testing.T) {
+	e := newTestEnv(t, "state-controls", 2, nil)
+	e.metrics.Set("load", 90)
+
+	e.a.pauseService(e.serviceID)
+	e.poll()
+	e.expectReplicas(2)
+
+	e.a.pinService(e.serviceID, 7, time.Hour)
+	e.poll()
+	e.expectReplicas(7)
+
+	e.a.resumeService(e.serviceID)
+	e.poll()
+	e.expectReplicas(8)
+}
+
+func TestPollTargetMode(t *testing.T) {
+	e := newTestEnv(t, "state-target", 4, map[string]string{
+		"auklet.mode":         ModeTarget,
+		"auklet.target_value": "50",
+	})
+	e.metrics.Set("load", 100)
+
+	e.poll()
+	e.expectReplicas(8)
+}
+
+func TestPollDownGracePeriod(t *testing.T) {
+	e := newTestEnv(t, "state-down-grace", 4, map[string]string{"auklet.down_graceperiod": "1m"})
+	e.metrics.Set("load", 10)
+
+	e.poll()
+	e.expectState(StateUnderThreshold)
+	e.pollAfter(59 * time.Second)
+	e.expectReplicas(4)
+
+	e.pollAfter(time.Second)
+	e.expectReplicas(3)
+}
+
+func TestPollUpCooldown(t *testing.T) {
+	e := newTestEnv(t, "state-up-cooldown", 2, map[string]string{"auklet.up_cooldown": "2m"})
+	e.metrics.Set("load", 90)
+
+	e.poll()
+	e.expectReplicas(3)
+	e.expectState(StateCooldown)
+	if until := e.svc.CooldownUntil; !until.Equal(testStart.Add(2 * time.Minute)) {
+		t.Errorf("expected the cooldown to end at +2m, got %s", until.Sub(testStart))
+	}
+
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	e.pollAfter(89 * time.Second)
+	e.expectReplicas(3)
+	e.expectState(StateCooldown)
+
+	// The cooldown expired at +2m
+	e.pollAfter(time.Second)
+	e.expectReplicas(4)
+}
+
+func TestPollCooldownScopeAny(t *testing.T) {
+	e := newTestEnv(t, "state-cooldown-any", 2, map[string]string{"auklet.up_cooldown": "2m"})
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.expectReplicas(3)
+
+	// The cooldown after scaling up also blocks scaling down
+	e.metrics.Set("load", 10)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	e.expectState(StateCooldown)
+
+	e.pollAfter(90 * time.Second)
+	e.expectReplicas(2)
+}
+
+func TestPollCooldownScopeSame(t *testing.T) {
+	e := newTestEnv(t, "state-cooldown-same", 2, map[string]string{
+		"auklet.up_cooldown":    "2m",
+		"auklet.cooldown_scope": CooldownScopeSame,
+	})
+	e.metrics.Set("load", 90)
+	e.poll()
+	e.expectReplicas(3)
+
+	// Scaling up again waits for the cooldown
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	e.expectState(StateCooldown)
+
+	// Scaling down doesn't
+	e.metrics.Set("load", 10)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(2)
+}
+
+func TestPollDeferredKeepsGracePeriod(t *testing.T) {
+	e := newTestEnv(t, "state-deferred", 2, map[string]string{"auklet.up_graceperiod": "1m"})
+	e.metrics.Set("load", 90)
+	e.poll()
+	grace := e.svc.GraceTimer
+
+	// A rolling update is in progress, so the scale action is deferred
+	s := e.orchestrator.Services[e.serviceID]
+	s.UpdateStatus.State = swarm.UpdateStateUpdating
+	e.orchestrator.NotReady[e.serviceID] = 1
+	e.pollAfter(time.Minute)
+	e.expectReplicas(2)
+	e.expectState(StateOverThreshold)
+	if e.svc.outcome != OutcomeDeferred {
+		t.Errorf("expected the scale action to be deferred, got %q", e.svc.outcome)
+	}
+	if !e.svc.GraceTimer.Equal(grace) {
+		t.Error("expected the grace period to be kept")
+	}
+
+	// Retried as soon as the service is ready, without a new grace period
+	s.UpdateStatus.State = swarm.UpdateStateCompleted
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+}
+
+func TestPollNotifiesFirstScaleFailure(t *testing.T) {
+	server, received := notificationServer(t)
+	defer server.Close()
+	e := newTestEnv(t, "state-scale-fails", 2, map[string]string{"auklet.notify.url": server.URL})
+	conflicts := &conflictingOrchestrator{FakeOrchestrator: e.orchestrator, conflicts: 3 * maxUpdateAttempts}
+	e.a.DockerClient = conflicts
+	defer e.skipBackoffs()()
+	e.metrics.Set("load", 90)
+
+	for i := 0; i < 3; i++ {
+		e.pollAfter(30 * time.Second)
+		if e.svc.outcome != OutcomeFailed {
+			t.Fatalf("expected the scale action to fail, got %q", e.svc.outcome)
+		}
+	}
+	e.expectReplicas(2)
+
+	// Succeeding ends the series of failures
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+
+	// The next failure is notified again
+	conflicts.conflicts = maxUpdateAttempts
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+
+	var outcomes []ScaleOutcome
+	for len(outcomes) < 3 {
+		select {
+		case n := <-received:
+			outcomes = append(outcomes, n.Outcome)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 notifications, got %v", outcomes)
+		}
+	}
+	select {
+	case n := <-received:
+		t.Errorf("unexpected notification: %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Notifications are sent in the background, so they may arrive in any
+	// order
+	counts := map[ScaleOutcome]int{}
+	for _, o := range outcomes {
+		counts[o]++
+	}
+	if counts[OutcomeFailed] != 2 || counts[OutcomeApplied] != 1 {
+		t.Errorf("expected 2 failed and 1 applied notifications, got %v", outcomes)
+	}
+}
+
+func TestPollGlobalService(t *testing.T) {
+	e := newTestEnv(t, "state-global", 2, nil)
+	s := e.orchestrator.Services[e.serviceID]
+	s.Spec.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	e.metrics.Set("load", 90)
+
+	if _, err := getService(e.a, s); err == nil {
+		t.Error("expected global services to be rejected")
+	}
+
+	// Polling a service that became global doesn't scale it
+	e.poll()
+	e.a.pinService(e.serviceID, 3, time.Hour)
+	e.poll()
+	if e.orchestrator.Updates != 0 {
+		t.Errorf("expected no updates, got %d", e.orchestrator.Updates)
+	}
+}
+
+func TestPollOnErrorRespectsCooldown(t *testing.T) {
+	e := newTestEnv(t, "state-on-error-cooldown", 2, map[string]string{
+		"auklet.on_error":       OnErrorScaleUp,
+		"auklet.on_error_after": "1",
+		"auklet.up_cooldown":    "2m",
+	})
+	e.metrics.SetError("load", errors.New("prometheus down"))
+
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+	e.expectState(StateCooldown)
+
+	// The fail-safe doesn't bypass the cooldown
+	for i := 0; i < 3; i++ {
+		e.pollAfter(30 * time.Second)
+	}
+	e.expectReplicas(3)
+
+	// The cooldown expired at +2m30s
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(4)
+}
+
+func TestPollOnErrorScaleDownRespectsCooldown(t *testing.T) {
+	e := newTestEnv(t, "state-on-error-down-cooldown", 5, map[string]string{
+		"auklet.on_error":       OnErrorScaleDown,
+		"auklet.on_error_after": "2",
+		"auklet.down_cooldown":  "3m",
+	})
+	e.metrics.SetError("load", errors.New("prometheus down"))
+
+	e.pollAfter(30 * time.Second)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(4)
+
+	// Every second failure applies the policy, but only after the cooldown
+	for i := 0; i < 5; i++ {
+		e.pollAfter(30 * time.Second)
+	}
+	e.expectReplicas(4)
+	e.pollAfter(30 * time.Second)
+	e.expectReplicas(3)
+}
@@ -0,0 +1,246 @@
+package auklet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/swarm"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// knownLabels are all labels Auklet reads from a service, apart from the
+// labels starting with scheduleLabelPrefix or metricLabelPrefix
+var knownLabels = map[string]bool{
+	"auklet.autoscale":         true,
+	"auklet.polling_interval":  true,
+	"auklet.scale_min":         true,
+	"auklet.scale_max":         true,
+	"auklet.mode":              true,
+	"auklet.up_step":           true,
+	"auklet.down_step":         true,
+	"auklet.query":             true,
+	"auklet.query_aggregation": true,
+	"auklet.query_empty":       true,
+	"auklet.up_threshold":      true,
+	"auklet.down_threshold":    true,
+	"auklet.target_value":      true,
+	"auklet.target_tolerance":  true,
+	"auklet.on_error":          true,
+	"auklet.on_error_after":    true,
+	"auklet.schedule_timezone": true,
+	"auklet.up_cooldown":       true,
+	"auklet.down_cooldown":     true,
+	"auklet.cooldown_scope":    true,
+	"auklet.dry_run":           true,
+	"auklet.up_graceperiod":    true,
+	"auklet.down_graceperiod":  true,
+	"auklet.notify.url":        true,
+	"auklet.notify.body":       true,
+	"auklet.notify.secret":     true,
+	"auklet.notify.events":     true,
+	"auklet.notify.retries":    true,
+	"auklet.notify.backoff":    true,
+	ProfileLabel:               true,
+	LeaderLabel:                true,
+	LeaderRenewedLabel:         true,
+	LastScaledAtLabel:          true,
+	LastScaleReasonLabel:       true,
+	LastMetricValueLabel:       true,
+}
+
+// ValidateLabels strictly validates the autoscaling configuration in the
+// labels of a service, and returns all problems found. Unlike the daemon, it
+// also reports unknown auklet.* labels, e.g. typos.
+func ValidateLabels(labels map[string]string) []error {
+	var errs []error
+
+	var unknown []string
+	for label := range labels {
+		if strings.HasPrefix(label, "auklet.") && !knownLabels[label] &&
+			!strings.HasPrefix(label, scheduleLabelPrefix) && !strings.HasPrefix(label, metricLabelPrefix) {
+			unknown = append(unknown, label)
+		}
+	}
+	sort.Strings(unknown)
+	for _, label := range unknown {
+		errs = append(errs, fmt.Errorf("unknown label %s", label))
+	}
+
+	return append(errs, validateConfig(labels)...)
+}
+
+// validateConfig checks that the autoscaling configuration in the labels of a
+// service can be parsed and is consistent, and returns all problems found.
+func validateConfig(labels map[string]string) []error {
+	s := &swarm.Service{}
+	s.Spec.Labels = labels
+
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, label := range []string{"auklet.autoscale", "auklet.dry_run"} {
+		if v, isSet := labels[label]; isSet {
+			if _, err := strconv.ParseBool(v); err != nil {
+				check(fmt.Errorf("invalid value for %s: %v", label, err))
+			}
+		}
+	}
+
+	if v, isSet := labels["auklet.polling_interval"]; isSet {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			check(fmt.Errorf("invalid value for auklet.polling_interval: %v", err))
+		} else if d <= 0 {
+			check(errors.New("auklet.polling_interval must be greater than 0s"))
+		}
+	}
+
+	scaleMin, errMin := getServiceLabelIntVal(s, "auklet.scale_min")
+	check(errMin)
+	scaleMax, errMax := getServiceLabelIntVal(s, "auklet.scale_max")
+	check(errMax)
+	if errMin == nil && scaleMin < 0 {
+		check(errors.New("auklet.scale_min must not be negative"))
+	}
+	if errMin == nil && errMax == nil && scaleMin > scaleMax {
+		check(fmt.Errorf("auklet.scale_min (%d) must not be greater than auklet.scale_max (%d)", scaleMin, scaleMax))
+	}
+
+	for _, label := range []string{"auklet.up_step", "auklet.down_step"} {
+		step, err := getServiceLabelIntVal(s, label, 1)
+		check(err)
+		if err == nil && step < 1 {
+			check(fmt.Errorf("%s must be at least 1", label))
+		}
+	}
+
+	for _, label := range []string{"auklet.up_graceperiod", "auklet.down_graceperiod", "auklet.up_cooldown", "auklet.down_cooldown"} {
+		_, err := getServiceLabelDurationVal(s, label, 0)
+		check(err)
+	}
+
+	if v, isSet := labels["auklet.cooldown_scope"]; isSet && v != CooldownScopeAny && v != CooldownScopeSame {
+		check(fmt.Errorf("invalid value for auklet.cooldown_scope: %q", v))
+	}
+
+	if v, isSet := labels["auklet.on_error"]; isSet && v != OnErrorHold && v != OnErrorScaleUp && v != OnErrorScaleDown {
+		check(fmt.Errorf("invalid value for auklet.on_error: %q", v))
+	}
+	onErrorAfter, err := getServiceLabelIntVal(s, "auklet.on_error_after", DefaultOnErrorAfter)
+	check(err)
+	if err == nil && onErrorAfter < 1 {
+		check(errors.New("auklet.on_error_after must be at least 1"))
+	}
+
+	_, err = getServiceSchedules(s)
+	check(err)
+
+	_, err = ParseNotify(labels, DefaultNotify())
+	check(err)
+
+	mode := ModeStep
+	if v, isSet := labels["auklet.mode"]; isSet {
+		mode = v
+	}
+	var tolerance float64
+	switch mode {
+	case ModeStep:
+	case ModeTarget:
+		tolerance, err = getServiceLabelFloatVal(s, "auklet.target_tolerance", DefaultTargetTolerance)
+		check(err)
+		if err == nil && (tolerance < 0 || tolerance >= 1) {
+			check(errors.New("auklet.target_tolerance must be at least 0 and less than 1"))
+		}
+	default:
+		check(fmt.Errorf("invalid value for auklet.mode: %q", mode))
+		return errs
+	}
+
+	metrics, err := getServiceMetrics(s, mode, tolerance)
+	check(err)
+	for _, m := range metrics {
+		if mode == ModeStep && m.DownThreshold >= m.UpThreshold {
+			check(fmt.Errorf("down_threshold (%g) of metric %s must be less than its up_threshold (%g)", m.DownThreshold, m.Name, m.UpThreshold))
+		}
+		query, err := m.render(sampleQueryContext)
+		if err != nil {
+			check(fmt.Errorf("invalid template in query of metric %s: %v", m.Name, err))
+		} else if err := checkQueryBrackets(query); err != nil {
+			check(fmt.Errorf("invalid query of metric %s: %v", m.Name, err))
+		}
+	}
+
+	return errs
+}
+
+// configError combines the problems found in the configuration of a service
+// into a single error
+func configError(errs []error) error {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// sampleQueryContext is used to render query templates for checking them
+var sampleQueryContext = QueryContext{
+	ServiceName:    "service",
+	ServiceID:      "id",
+	StackNamespace: "stack",
+	Replicas:       1,
+}
+
+// checkQueryBrackets checks that a rendered query isn't empty, and that all
+// its brackets and string literals are closed. This is not a PromQL parser:
+// queries like `rate(foo)` pass, and only fail once Prometheus executes them.
+func checkQueryBrackets(query string) error {
+	if strings.TrimSpace(query) == "" {
+		return errors.New("query is empty")
+	}
+
+	closing := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var open []rune
+	var quote rune
+	escaped := false
+
+	for i, c := range query {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\' && quote != '`':
+				escaped = true
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			open = append(open, c)
+		case ')', ']', '}':
+			if len(open) == 0 || open[len(open)-1] != closing[c] {
+				return fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+
+	if quote != 0 {
+		return fmt.Errorf("unterminated string literal (%c)", quote)
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed %q", open[len(open)-1])
+	}
+	return nil
+}
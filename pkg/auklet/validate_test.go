@@ -0,0 +1,71 @@
+package auklet
+
+import (
+	"testing"
+)
+
+func TestCheckQueryBrackets(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{`up`, true},
+		{`sum(rate(http_requests_total{job="web"}[1m]))`, true},
+		{``, false},
+		{"  \t", false},
+		{`sum(rate(http_requests_total[1m])`, false},
+		{`sum(rate(http_requests_total[1m)))`, false},
+		{`sum(rate(http_requests_total[1m)])`, false},
+		{`http_requests_total{job="web"`, false},
+		// Brackets in string literals don't count
+		{`up{job="web)"}`, true},
+		{`up{job='[web'}`, true},
+		{`up{job="web\")"}`, true},
+		{`up{job="web`, false},
+		{`up{job='web}`, false},
+		// No escapes in backticks
+		{"up{job=`web\\`}", true},
+		{"up{job=`web}", false},
+		// Not a PromQL parser
+		{`rate(foo)`, true},
+		{`sum by foo (x)`, true},
+	}
+
+	for _, test := range tests {
+		err := checkQueryBrackets(test.query)
+		if test.valid && err != nil {
+			t.Errorf("checkQueryBrackets(%q): unexpected error: %v", test.query, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("checkQueryBrackets(%q): expected an error", test.query)
+		}
+	}
+}
+
+func TestValidateLabelsRendersQueries(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{`sum(rate(http_requests_total{service="{{.ServiceName}}"}[1m]))`, true},
+		{`avg(cpu{service_id="{{.ServiceID}}", stack="{{.StackNamespace}}"}) * {{.Replicas}}`, true},
+		{`avg(cpu{service="{{.ServiceName}}"}`, false},
+		// The brackets of the rendered query count, not those of the template
+		{`sum(up{job="{{"(" | printf "%s"}}"})`, true},
+		{`sum(up) {{"(" | printf "%s"}}`, false},
+		// Template errors
+		{`avg(cpu) * {{.Replicas}`, false},
+		{`avg(cpu{service="{{.Unknown}}"})`, false},
+		{`{{/* nothing */}}`, false},
+	}
+
+	for _, test := range tests {
+		errs := ValidateLabels(testLabels(map[string]string{"auklet.query": test.query}))
+		if test.valid && len(errs) > 0 {
+			t.Errorf("%q: unexpected errors: %v", test.query, errs)
+		}
+		if !test.valid && len(errs) == 0 {
+			t.Errorf("%q: expected an error", test.query)
+		}
+	}
+}